@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strconv"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +13,7 @@ import (
 	"github.com/lib/pq"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/utils"
+	"github.com/sirupsen/logrus"
 )
 
 // getChannel will look up the channel with the passed in UUID and channel type.
@@ -45,6 +46,11 @@ func getChannel(ctx context.Context, db *sqlx.DB, channelType courier.ChannelTyp
 		return nil, dbErr
 	}
 
+	// if its config changed since we last cached it, let its handler know
+	if cachedChannel != nil && !reflect.DeepEqual(cachedChannel.Config_, channel.Config_) {
+		notifyChannelConfigChanged(ctx, channel)
+	}
+
 	// we found it in the db, cache it locally
 	cacheChannel(channel)
 	return channel, nil
@@ -134,6 +140,20 @@ func clearLocalChannel(uuid courier.ChannelUUID) {
 	cacheMutex.Unlock()
 }
 
+// notifyChannelConfigChanged tells the handler of the passed in channel that its config has changed if it is a
+// ChannelConfigListener. Changes are noticed when channels are reloaded after their cached copy expires.
+func notifyChannelConfigChanged(ctx context.Context, channel *DBChannel) {
+	listener, isListener := courier.GetHandler(channel.ChannelType()).(courier.ChannelConfigListener)
+	if !isListener {
+		return
+	}
+
+	err := listener.ChannelConfigChanged(ctx, channel)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error notifying handler of channel config change")
+	}
+}
+
 // channels stay cached in memory for a minute at a time
 const localTTL = 60 * time.Second
 
@@ -170,6 +190,11 @@ func getChannelByAddress(ctx context.Context, db *sqlx.DB, channelType courier.C
 		return nil, dbErr
 	}
 
+	// if its config changed since we last cached it, let its handler know
+	if cachedChannel != nil && !reflect.DeepEqual(cachedChannel.Config_, channel.Config_) {
+		notifyChannelConfigChanged(ctx, channel)
+	}
+
 	// we found it in the db, cache it locally
 	cacheChannel(channel)
 	return channel, nil
@@ -401,32 +426,12 @@ func (c *DBChannel) StringConfigForKey(key string, defaultValue string) string {
 
 // BoolConfigForKey returns the config value for the passed in key, or defaultValue if it isn't found
 func (c *DBChannel) BoolConfigForKey(key string, defaultValue bool) bool {
-	val := c.ConfigForKey(key, defaultValue)
-	b, isBool := val.(bool)
-	if !isBool {
-		return defaultValue
-	}
-	return b
+	return courier.BoolConfigForKey(c, key, defaultValue)
 }
 
 // IntConfigForKey returns the config value for the passed in key
 func (c *DBChannel) IntConfigForKey(key string, defaultValue int) int {
-	val := c.ConfigForKey(key, defaultValue)
-
-	// golang unmarshals number literals in JSON into float64s by default
-	f, isFloat := val.(float64)
-	if isFloat {
-		return int(f)
-	}
-
-	str, isStr := val.(string)
-	if isStr {
-		i, err := strconv.Atoi(str)
-		if err == nil {
-			return i
-		}
-	}
-	return defaultValue
+	return courier.IntConfigForKey(c, key, defaultValue)
 }
 
 // supportsScheme returns whether the passed in channel supports the passed in scheme
@@ -122,9 +122,9 @@ func newMsg(direction MsgDirection, channel courier.Channel, urn urns.URN, text
 const insertMsgSQL = `
 INSERT INTO
 	msgs_msg(org_id, uuid, direction, text, attachments, msg_count, error_count, high_priority, status,
-             visibility, external_id, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on, sent_on)
+             visibility, external_id, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on, sent_on, metadata)
     VALUES(:org_id, :uuid, :direction, :text, :attachments, :msg_count, :error_count, :high_priority, :status,
-           :visibility, :external_id, :channel_id, :contact_id, :contact_urn_id, :created_on, :modified_on, :next_attempt, :queued_on, :sent_on)
+           :visibility, :external_id, :channel_id, :contact_id, :contact_urn_id, :created_on, :modified_on, :next_attempt, :queued_on, :sent_on, convert_from(:metadata, 'UTF8'))
 RETURNING id
 `
 
@@ -581,6 +581,16 @@ func (m *DBMsg) Topic() string {
 	return string(topic)
 }
 
+// Campaign returns the campaign or label this message was sent as part of, if any, so that channels can report on
+// them separately. It is read from the campaign key of the message's metadata.
+func (m *DBMsg) Campaign() string {
+	if m.Metadata_ == nil {
+		return ""
+	}
+	campaign, _ := jsonparser.GetString(m.Metadata_, "campaign")
+	return campaign
+}
+
 // Metadata returns the metadata for this message
 func (m *DBMsg) Metadata() json.RawMessage {
 	return m.Metadata_
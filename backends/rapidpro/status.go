@@ -102,8 +102,14 @@ UPDATE msgs_msg SET
 	next_attempt = CASE 
 		WHEN 
 			:status = 'E' 
-		THEN 
-			NOW() + (5 * (error_count+1) * interval '1 minutes') 
+		THEN CASE
+			WHEN
+				:retry_after_seconds > 0
+			THEN
+				NOW() + (:retry_after_seconds * interval '1 seconds')
+			ELSE
+				NOW() + (5 * (error_count+1) * interval '1 minutes') 
+			END
 		ELSE 
 			next_attempt 
 		END,
@@ -159,8 +165,14 @@ UPDATE msgs_msg SET
 	next_attempt = CASE 
 		WHEN 
 			:status = 'E' 
-		THEN 
-			NOW() + (5 * (error_count+1) * interval '1 minutes') 
+		THEN CASE
+			WHEN
+				:retry_after_seconds > 0
+			THEN
+				NOW() + (:retry_after_seconds * interval '1 seconds')
+			ELSE
+				NOW() + (5 * (error_count+1) * interval '1 minutes') 
+			END
 		ELSE 
 			next_attempt 
 		END,
@@ -258,8 +270,14 @@ UPDATE msgs_msg SET
 	next_attempt = CASE 
 		WHEN 
 			s.status = 'E' 
-		THEN 
-			NOW() + (5 * (error_count+1) * interval '1 minutes') 
+		THEN CASE
+			WHEN
+				s.retry_after_seconds::int > 0
+			THEN
+				NOW() + (s.retry_after_seconds::int * interval '1 seconds')
+			ELSE
+				NOW() + (5 * (error_count+1) * interval '1 minutes') 
+			END
 		ELSE 
 			next_attempt 
 		END,
@@ -281,9 +299,9 @@ UPDATE msgs_msg SET
 		END,
 	modified_on = NOW()
 FROM
-	(VALUES(:msg_id, :channel_id, :status, :external_id)) 
+	(VALUES(:msg_id, :channel_id, :status, :external_id, :retry_after_seconds)) 
 AS 
-	s(msg_id, channel_id, status, external_id) 
+	s(msg_id, channel_id, status, external_id, retry_after_seconds) 
 WHERE 
 	msgs_msg.id = s.msg_id::bigint AND
 	msgs_msg.channel_id = s.channel_id::int AND 
@@ -307,6 +325,9 @@ type DBMsgStatus struct {
 	Status_      courier.MsgStatusValue `json:"status"                   db:"status"`
 	ModifiedOn_  time.Time              `json:"modified_on"              db:"modified_on"`
 
+	RetryAfterSeconds_ int                     `json:"retry_after_seconds,omitempty" db:"retry_after_seconds"`
+	Reason_            courier.MsgStatusReason `json:"reason,omitempty"              db:"reason"`
+
 	logs []*courier.ChannelLog
 }
 
@@ -359,3 +380,15 @@ func (s *DBMsgStatus) AddLog(log *courier.ChannelLog) { s.logs = append(s.logs,
 
 func (s *DBMsgStatus) Status() courier.MsgStatusValue          { return s.Status_ }
 func (s *DBMsgStatus) SetStatus(status courier.MsgStatusValue) { s.Status_ = status }
+
+func (s *DBMsgStatus) RetryAfter() time.Duration {
+	return time.Duration(s.RetryAfterSeconds_) * time.Second
+}
+
+func (s *DBMsgStatus) SetRetryAfter(retryAfter time.Duration) {
+	// round up so we never retry sooner than we were asked to
+	s.RetryAfterSeconds_ = int((retryAfter + time.Second - 1) / time.Second)
+}
+
+func (s *DBMsgStatus) Reason() courier.MsgStatusReason          { return s.Reason_ }
+func (s *DBMsgStatus) SetReason(reason courier.MsgStatusReason) { s.Reason_ = reason }
@@ -28,6 +28,11 @@ func queueMsgHandling(rc redis.Conn, c *DBContact, m *DBMsg) error {
 		"created_on":      m.CreatedOn_,
 	}
 
+	// handlers can tag messages with metadata, e.g. the keyword they were routed by, which flows can branch on
+	if len(m.Metadata_) > 0 {
+		body["metadata"] = m.Metadata_
+	}
+
 	return queueMailroomTask(rc, "msg_event", m.OrgID_, m.ContactID_, body)
 }
 
@@ -42,6 +47,16 @@ func queueChannelEvent(rc redis.Conn, c *DBContact, e *DBChannelEvent) error {
 		}
 		return queueMailroomTask(rc, "stop_event", e.OrgID_, e.ContactID_, body)
 
+	case courier.StartContact:
+		body := map[string]interface{}{
+			"org_id":      e.OrgID_,
+			"contact_id":  e.ContactID_,
+			"urn_id":      e.ContactURNID_,
+			"channel_id":  e.ChannelID_,
+			"occurred_on": e.OccurredOn_,
+		}
+		return queueMailroomTask(rc, "start_event", e.OrgID_, e.ContactID_, body)
+
 	case courier.WelcomeMessage:
 		body := map[string]interface{}{
 			"org_id":      e.OrgID_,
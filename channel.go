@@ -3,9 +3,11 @@ package courier
 import (
 	"database/sql/driver"
 	"errors"
+	"strconv"
 	"strings"
 
 	"github.com/nyaruka/null"
+	"github.com/sirupsen/logrus"
 
 	"github.com/gofrs/uuid"
 )
@@ -47,6 +49,9 @@ const (
 	// ConfigSendURL is a constant key for channel configs
 	ConfigSendURL = "send_url"
 
+	// ConfigUserAgent is the User-Agent header sent on requests made for the channel, overriding our default
+	ConfigUserAgent = "user_agent"
+
 	// ConfigUsername is a constant key for channel configs
 	ConfigUsername = "username"
 
@@ -170,3 +175,57 @@ type Channel interface {
 	IntConfigForKey(key string, defaultValue int) int
 	OrgConfigForKey(key string, defaultValue interface{}) interface{}
 }
+
+// BoolConfigForKey returns the config value of the passed in channel for the passed in key as a bool. Besides JSON
+// booleans it accepts strings like "true", "1", "yes" and "on" or "false", "0", "no" and "off", and the numbers 1 and
+// 0. Values which can't be parsed are warned about and defaultValue is returned. Channel implementations can use
+// this for their BoolConfigForKey so that they all parse configs the same way.
+func BoolConfigForKey(c Channel, key string, defaultValue bool) bool {
+	switch val := c.ConfigForKey(key, defaultValue).(type) {
+	case bool:
+		return val
+	case float64:
+		if val == 1 || val == 0 {
+			return val == 1
+		}
+	case int:
+		if val == 1 || val == 0 {
+			return val == 1
+		}
+	case string:
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "true", "1", "yes", "on":
+			return true
+		case "false", "0", "no", "off":
+			return false
+		}
+	}
+
+	warnInvalidConfig(c, key, "bool")
+	return defaultValue
+}
+
+// IntConfigForKey returns the config value of the passed in channel for the passed in key as an int. Besides JSON
+// numbers, which are truncated, it accepts strings of integers. Values which can't be parsed are warned about and
+// defaultValue is returned. Channel implementations can use this for their IntConfigForKey so that they all parse
+// configs the same way.
+func IntConfigForKey(c Channel, key string, defaultValue int) int {
+	switch val := c.ConfigForKey(key, defaultValue).(type) {
+	// golang unmarshals number literals in JSON into float64s by default
+	case float64:
+		return int(val)
+	case int:
+		return val
+	case string:
+		if i, err := strconv.Atoi(strings.TrimSpace(val)); err == nil {
+			return i
+		}
+	}
+
+	warnInvalidConfig(c, key, "int")
+	return defaultValue
+}
+
+func warnInvalidConfig(c Channel, key string, kind string) {
+	logrus.WithField("channel_uuid", c.UUID()).WithField("channel_type", c.ChannelType()).WithField("key", key).WithField("value", c.ConfigForKey(key, nil)).Warnf("invalid %s channel config, using default", kind)
+}
@@ -13,6 +13,7 @@ type ChannelEventType string
 const (
 	NewConversation ChannelEventType = "new_conversation"
 	Referral        ChannelEventType = "referral"
+	StartContact    ChannelEventType = "start_contact"
 	StopContact     ChannelEventType = "stop_contact"
 	WelcomeMessage  ChannelEventType = "welcome_message"
 )
@@ -0,0 +1,109 @@
+package courier
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoolConfigForKey(t *testing.T) {
+	tcs := []struct {
+		value    interface{}
+		expected bool
+		warned   bool
+	}{
+		{true, true, false},
+		{false, false, false},
+		{"true", true, false},
+		{" TRUE ", true, false},
+		{"1", true, false},
+		{"yes", true, false},
+		{"on", true, false},
+		{"false", false, false},
+		{"0", false, false},
+		{"No", false, false},
+		{"off", false, false},
+		{float64(1), true, false},
+		{float64(0), false, false},
+		{1, true, false},
+		{0, false, false},
+		{"", true, true},
+		{"maybe", true, true},
+		{float64(2), true, true},
+		{[]interface{}{true}, true, true},
+	}
+
+	for _, tc := range tcs {
+		hook := logtest.NewGlobal()
+		channel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"flag": tc.value})
+
+		// our default is true so parse failures are distinguishable from false values
+		assert.Equal(t, tc.expected, BoolConfigForKey(channel, "flag", true), "unexpected value for %#v", tc.value)
+		assert.Equal(t, tc.expected, channel.BoolConfigForKey("flag", true), "unexpected value for %#v", tc.value)
+		assert.Equal(t, tc.warned, len(hook.AllEntries()) > 0, "unexpected warning for %#v", tc.value)
+
+		if tc.warned {
+			entry := hook.LastEntry()
+			assert.Equal(t, logrus.WarnLevel, entry.Level)
+			assert.Equal(t, "invalid bool channel config, using default", entry.Message)
+			assert.Equal(t, "flag", entry.Data["key"])
+		}
+	}
+	logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	// missing values are the default without any warning
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	channel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+	assert.True(t, channel.BoolConfigForKey("flag", true))
+	assert.False(t, channel.BoolConfigForKey("flag", false))
+	assert.Equal(t, 0, len(hook.AllEntries()))
+}
+
+func TestIntConfigForKey(t *testing.T) {
+	tcs := []struct {
+		value    interface{}
+		expected int
+		warned   bool
+	}{
+		{float64(30), 30, false},
+		{float64(2.9), 2, false},
+		{float64(-5), -5, false},
+		{12, 12, false},
+		{"45", 45, false},
+		{" 45 ", 45, false},
+		{"-3", -3, false},
+		{"", 10, true},
+		{"4.5", 10, true},
+		{"ten", 10, true},
+		{true, 10, true},
+		{map[string]interface{}{"value": 1}, 10, true},
+	}
+
+	for _, tc := range tcs {
+		hook := logtest.NewGlobal()
+		channel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"count": tc.value})
+
+		assert.Equal(t, tc.expected, IntConfigForKey(channel, "count", 10), "unexpected value for %#v", tc.value)
+		assert.Equal(t, tc.expected, channel.IntConfigForKey("count", 10), "unexpected value for %#v", tc.value)
+		assert.Equal(t, tc.warned, len(hook.AllEntries()) > 0, "unexpected warning for %#v", tc.value)
+
+		if tc.warned {
+			entry := hook.LastEntry()
+			assert.Equal(t, "invalid int channel config, using default", entry.Message)
+			assert.Equal(t, "count", entry.Data["key"])
+		}
+	}
+	logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	// missing values are the default without any warning
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	channel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+	assert.Equal(t, 10, channel.IntConfigForKey("count", 10))
+	assert.Equal(t, 0, len(hook.AllEntries()))
+}
@@ -29,6 +29,8 @@ type Config struct {
 	StatusPassword            string `help:"the password that is needed to authenticate against the /status endpoint"`
 	LogLevel                  string `help:"the logging level courier should use"`
 	Version                   string `help:"the version that will be used in request and response headers"`
+	MaxResponseBodyBytes      int    `help:"the most bytes of each provider response body that will be read, larger bodies are truncated and treated as errors (set to 0 to read bodies in full)"`
+	RedisKeyPrefix            string `help:"the prefix that will be added to the Redis keys handlers use, so that several deployments can share a Redis instance"`
 
 	// IncludeChannels is the list of channels to enable, empty means include all
 	IncludeChannels []string
@@ -60,6 +62,8 @@ func NewConfig() *Config {
 		MaxWorkers:                32,
 		LogLevel:                  "error",
 		Version:                   "Dev",
+		MaxResponseBodyBytes:      4 * 1024 * 1024,
+		RedisKeyPrefix:            "",
 	}
 }
 
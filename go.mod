@@ -1,6 +1,7 @@
 module github.com/nyaruka/courier
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.1
 	github.com/antchfx/xmlquery v0.0.0-20181223105952-355641961c92
 	github.com/antchfx/xpath v0.0.0-20181208024549-4bbdf6db12aa // indirect
 	github.com/aws/aws-sdk-go v1.34.31
@@ -25,10 +26,13 @@ require (
 	github.com/nyaruka/gocommon v1.6.1
 	github.com/nyaruka/librato v1.0.0
 	github.com/nyaruka/null v1.1.1
+	github.com/nyaruka/phonenumbers v1.0.58
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
+	golang.org/x/text v0.3.3
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1
 	gopkg.in/go-playground/validator.v9 v9.11.0
@@ -2,7 +2,10 @@ package courier
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sort"
+	"sync"
 
 	"github.com/nyaruka/gocommon/urns"
 )
@@ -33,6 +36,24 @@ type URNDescriber interface {
 	DescribeURN(context.Context, Channel, urns.URN) (map[string]string, error)
 }
 
+// ConfigValidator is the interface handlers which can check a channel's configuration with their provider, e.g. that
+// its credentials are accepted, without sending a message should satisfy.
+type ConfigValidator interface {
+	ValidateConfig(context.Context, Channel) error
+}
+
+// TokenWarmer is the interface handlers which cache access tokens should satisfy so that a background job can make sure
+// a channel has a token cached before any of its messages need one.
+type TokenWarmer interface {
+	WarmToken(context.Context, Channel) error
+}
+
+// ChannelConfigListener is the interface handlers which keep state derived from a channel's config, e.g. access tokens
+// fetched with its credentials, should satisfy so that they can discard it when that config changes.
+type ChannelConfigListener interface {
+	ChannelConfigChanged(context.Context, Channel) error
+}
+
 // MediaDownloadRequestBuilder is the interface handlers which can allow a custom way to download attachment media for messages should satisfy
 type MediaDownloadRequestBuilder interface {
 	BuildDownloadMediaRequest(context.Context, Backend, Channel, string) (*http.Request, error)
@@ -40,13 +61,51 @@ type MediaDownloadRequestBuilder interface {
 
 // RegisterHandler adds a new handler for a channel type, this is called by individual handlers when they are initialized
 func RegisterHandler(handler ChannelHandler) {
+	registeredHandlersMutex.Lock()
+	defer registeredHandlersMutex.Unlock()
+
 	registeredHandlers[handler.ChannelType()] = handler
 }
 
+// ErrUnknownChannelType is returned when looking up the handler of a channel type which no handler is registered for
+type ErrUnknownChannelType struct {
+	ChannelType ChannelType
+}
+
+func (e *ErrUnknownChannelType) Error() string {
+	return fmt.Sprintf("no handler registered for channel type '%s'", e.ChannelType)
+}
+
 // GetHandler returns the handler for the passed in channel type, or nil if not found
 func GetHandler(ct ChannelType) ChannelHandler {
+	registeredHandlersMutex.RLock()
+	defer registeredHandlersMutex.RUnlock()
+
 	return registeredHandlers[ct]
 }
 
+// LookupHandler returns the handler for the passed in channel type, or an ErrUnknownChannelType if none is registered
+func LookupHandler(ct ChannelType) (ChannelHandler, error) {
+	handler := GetHandler(ct)
+	if handler == nil {
+		return nil, &ErrUnknownChannelType{ChannelType: ct}
+	}
+	return handler, nil
+}
+
+// RegisteredHandlers returns a snapshot of all the handlers which have been registered, sorted by channel type
+func RegisteredHandlers() []ChannelHandler {
+	registeredHandlersMutex.RLock()
+	defer registeredHandlersMutex.RUnlock()
+
+	handlers := make([]ChannelHandler, 0, len(registeredHandlers))
+	for _, handler := range registeredHandlers {
+		handlers = append(handlers, handler)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].ChannelType() < handlers[j].ChannelType() })
+	return handlers
+}
+
 var registeredHandlers = make(map[ChannelType]ChannelHandler)
+var registeredHandlersMutex sync.RWMutex
 var activeHandlers = make(map[ChannelType]ChannelHandler)
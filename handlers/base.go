@@ -43,6 +43,14 @@ func (h *BaseHandler) Backend() courier.Backend {
 	return h.backend
 }
 
+// RedisKeyPrefix returns the prefix configured for the server that handlers should add to the Redis keys they use
+func (h *BaseHandler) RedisKeyPrefix() string {
+	if h.server == nil || h.server.Config() == nil {
+		return ""
+	}
+	return h.server.Config().RedisKeyPrefix
+}
+
 // ChannelType returns the channel type that this handler deals with
 func (h *BaseHandler) ChannelType() courier.ChannelType {
 	return h.channelType
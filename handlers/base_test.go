@@ -72,3 +72,13 @@ func TestSplitMsgByChannel(t *testing.T) {
 	assert.Equal([]string{" "}, SplitMsgByChannel(channelWithMaxLength, " ", 20))
 	assert.Equal([]string{"This is a message", "longer than 10"}, SplitMsgByChannel(channelWithMaxLength, "This is a message   longer than 10", 20))
 }
+
+func TestRedisKeyPrefix(t *testing.T) {
+	h := NewBaseHandler(courier.ChannelType("AC"), "Test")
+	assert.Equal(t, "", h.RedisKeyPrefix())
+
+	config := courier.NewConfig()
+	config.RedisKeyPrefix = "staging:"
+	h.SetServer(courier.NewServer(config, courier.NewMockBackend()))
+	assert.Equal(t, "staging:", h.RedisKeyPrefix())
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+)
+
+// the prefix of the redis keys we keep the state of each channel's circuit breaker under
+const breakerPrefix = "breaker_"
+
+// BreakerState is the state of a channel's circuit breaker
+type BreakerState string
+
+// the states a circuit breaker can be in
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// CircuitBreaker stops us making requests to an endpoint which keeps failing. It opens after Threshold consecutive
+// failures, none more than Window apart, and while open all requests are refused. After Cooldown it becomes half open,
+// letting a single probe request through. If that succeeds the breaker closes, otherwise it opens again.
+//
+// State is kept in Redis so that it's shared by all our instances, under keys starting with KeyPrefix. A nil pool or a
+// Threshold of zero or less means requests are never refused.
+type CircuitBreaker struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	KeyPrefix string
+}
+
+// Allow returns the state of the breaker for the passed in channel and whether a request can be made. In the half open
+// state only the caller which gets to make the probe request is allowed.
+func (b *CircuitBreaker) Allow(rp *redis.Pool, channel courier.Channel) (BreakerState, bool, error) {
+	if rp == nil || b.Threshold <= 0 {
+		return BreakerClosed, true, nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	open, err := redis.Bool(conn.Do("EXISTS", b.key(channel, "open")))
+	if err != nil {
+		return BreakerClosed, true, err
+	}
+	if open {
+		return BreakerOpen, false, nil
+	}
+
+	tripped, err := redis.Bool(conn.Do("EXISTS", b.key(channel, "tripped")))
+	if err != nil {
+		return BreakerClosed, true, err
+	}
+	if !tripped {
+		return BreakerClosed, true, nil
+	}
+
+	// we're half open, only one caller gets to probe whether the endpoint has recovered
+	_, err = redis.String(conn.Do("SET", b.key(channel, "probe"), "1", "EX", seconds(b.Cooldown), "NX"))
+	if err == redis.ErrNil {
+		return BreakerHalfOpen, false, nil
+	}
+	if err != nil {
+		return BreakerHalfOpen, true, err
+	}
+	return BreakerHalfOpen, true, nil
+}
+
+// RecordSuccess records a successful request for the passed in channel, returning whether that closed its breaker
+func (b *CircuitBreaker) RecordSuccess(rp *redis.Pool, channel courier.Channel) (bool, error) {
+	if rp == nil || b.Threshold <= 0 {
+		return false, nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	tripped, err := redis.Bool(conn.Do("EXISTS", b.key(channel, "tripped")))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = conn.Do("DEL", b.key(channel, "failures"), b.key(channel, "tripped"), b.key(channel, "probe"))
+	return tripped && err == nil, err
+}
+
+// RecordFailure records a failed request for the passed in channel, returning whether that opened its breaker
+func (b *CircuitBreaker) RecordFailure(rp *redis.Pool, channel courier.Channel) (bool, error) {
+	if rp == nil || b.Threshold <= 0 {
+		return false, nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	failuresKey := b.key(channel, "failures")
+	failures, err := redis.Int(conn.Do("INCR", failuresKey))
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.Do("EXPIRE", failuresKey, seconds(b.Window)); err != nil {
+		return false, err
+	}
+
+	// a failed probe opens the breaker again straight away
+	tripped, err := redis.Bool(conn.Do("EXISTS", b.key(channel, "tripped")))
+	if err != nil {
+		return false, err
+	}
+	if failures < b.Threshold && !tripped {
+		return false, nil
+	}
+
+	if _, err := conn.Do("SETEX", b.key(channel, "open"), seconds(b.Cooldown), "1"); err != nil {
+		return false, err
+	}
+
+	// we stay tripped until a probe succeeds, but don't keep the state of channels that stop sending around forever
+	if _, err := conn.Do("SETEX", b.key(channel, "tripped"), seconds(b.Cooldown+b.Window)*10, "1"); err != nil {
+		return false, err
+	}
+	if _, err := conn.Do("DEL", b.key(channel, "probe")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *CircuitBreaker) key(channel courier.Channel, name string) string {
+	return fmt.Sprintf("%s%s%s_%s", b.KeyPrefix, breakerPrefix, channel.UUID(), name)
+}
+
+// seconds returns the passed in duration in whole seconds, which is never less than one
+func seconds(d time.Duration) int {
+	s := int(d / time.Second)
+	if s < 1 {
+		return 1
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	rp := courier.NewMockBackend().RedisPool()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+	breaker := &CircuitBreaker{Threshold: 3, Window: time.Minute, Cooldown: 30 * time.Second}
+
+	assertAllow := func(expectedState BreakerState, expectedAllowed bool) {
+		state, allowed, err := breaker.Allow(rp, channel)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedState, state)
+		assert.Equal(t, expectedAllowed, allowed)
+	}
+
+	// failures below our threshold leave us closed
+	for i := 0; i < 2; i++ {
+		opened, err := breaker.RecordFailure(rp, channel)
+		assert.NoError(t, err)
+		assert.False(t, opened)
+	}
+	assertAllow(BreakerClosed, true)
+
+	// and a success resets our count
+	closed, err := breaker.RecordSuccess(rp, channel)
+	assert.NoError(t, err)
+	assert.False(t, closed)
+
+	for i := 0; i < 2; i++ {
+		opened, _ := breaker.RecordFailure(rp, channel)
+		assert.False(t, opened)
+	}
+	assertAllow(BreakerClosed, true)
+
+	// but reaching it opens the breaker
+	opened, err := breaker.RecordFailure(rp, channel)
+	assert.NoError(t, err)
+	assert.True(t, opened)
+	assertAllow(BreakerOpen, false)
+
+	// other channels have their own breakers
+	other := courier.NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "AC", "2020", "US", nil)
+	state, allowed, err := breaker.Allow(rp, other)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerClosed, state)
+	assert.True(t, allowed)
+
+	// as do breakers with a different key prefix
+	staging := &CircuitBreaker{Threshold: 3, Window: time.Minute, Cooldown: 30 * time.Second, KeyPrefix: "staging:"}
+	state, allowed, err = staging.Allow(rp, channel)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerClosed, state)
+	assert.True(t, allowed)
+
+	// once our cooldown is over we let a single probe through
+	conn := rp.Get()
+	defer conn.Close()
+	conn.Do("DEL", breaker.key(channel, "open"))
+
+	assertAllow(BreakerHalfOpen, true)
+	assertAllow(BreakerHalfOpen, false)
+
+	// a failed probe opens us again
+	opened, err = breaker.RecordFailure(rp, channel)
+	assert.NoError(t, err)
+	assert.True(t, opened)
+	assertAllow(BreakerOpen, false)
+
+	// and a successful one closes us
+	conn.Do("DEL", breaker.key(channel, "open"))
+	assertAllow(BreakerHalfOpen, true)
+
+	closed, err = breaker.RecordSuccess(rp, channel)
+	assert.NoError(t, err)
+	assert.True(t, closed)
+	assertAllow(BreakerClosed, true)
+
+	// without redis, or a threshold, we're always closed
+	state, allowed, err = breaker.Allow(nil, channel)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerClosed, state)
+	assert.True(t, allowed)
+
+	disabled := &CircuitBreaker{}
+	for i := 0; i < 5; i++ {
+		opened, err := disabled.RecordFailure(rp, other)
+		assert.NoError(t, err)
+		assert.False(t, opened)
+	}
+	state, allowed, err = disabled.Allow(rp, other)
+	assert.NoError(t, err)
+	assert.Equal(t, BreakerClosed, state)
+	assert.True(t, allowed)
+}
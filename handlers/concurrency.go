@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+)
+
+// the prefix of the redis keys we count the requests in flight for each channel under
+const inFlightPrefix = "in_flight_"
+
+// how many seconds our redis counts of in flight requests live after their last acquire, so that the slots of workers
+// which died without releasing them are eventually freed
+const inFlightTTL = 300
+
+// ConcurrencyLimiter limits how many requests can be in flight for each channel at once. Slots are counted in this
+// process, so each worker gets its own share, unless Acquire is passed a redis pool to share them across all workers
+// under keys starting with KeyPrefix. The zero value is ready to use.
+type ConcurrencyLimiter struct {
+	KeyPrefix string
+
+	inFlight map[courier.ChannelUUID]int
+	mutex    sync.Mutex
+}
+
+// Acquire takes one of the maxInFlight slots of the passed in channel, returning false if they're all taken. The
+// returned function gives the slot back and should be called once the request is finished, it does nothing if no slot
+// was taken. A maxInFlight of zero or less means the channel isn't limited.
+func (l *ConcurrencyLimiter) Acquire(rp *redis.Pool, channel courier.Channel, maxInFlight int) (func(), bool, error) {
+	release := func() {}
+	if maxInFlight <= 0 {
+		return release, true, nil
+	}
+
+	if rp != nil {
+		return acquireRedisSlot(rp, l.KeyPrefix+inFlightPrefix+channel.UUID().String(), maxInFlight)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inFlight == nil {
+		l.inFlight = make(map[courier.ChannelUUID]int)
+	}
+	if l.inFlight[channel.UUID()] >= maxInFlight {
+		return release, false, nil
+	}
+	l.inFlight[channel.UUID()]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			l.inFlight[channel.UUID()]--
+			if l.inFlight[channel.UUID()] <= 0 {
+				delete(l.inFlight, channel.UUID())
+			}
+		})
+	}, true, nil
+}
+
+// InFlight returns how many of the passed in channel's slots counted in this process are taken
+func (l *ConcurrencyLimiter) InFlight(channel courier.Channel) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.inFlight[channel.UUID()]
+}
+
+func acquireRedisSlot(rp *redis.Pool, key string, maxInFlight int) (func(), bool, error) {
+	release := func() {}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("INCR", key))
+	if err != nil {
+		return release, false, err
+	}
+	if _, err := conn.Do("EXPIRE", key, inFlightTTL); err != nil {
+		return release, false, err
+	}
+
+	// over our limit? give back the slot we just took
+	if count > maxInFlight {
+		_, err := conn.Do("DECR", key)
+		return release, false, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			conn := rp.Get()
+			defer conn.Close()
+
+			// our key may have expired and been recreated while we were in flight, never leave it counting below zero
+			count, err := redis.Int(conn.Do("DECR", key))
+			if err == nil && count < 0 {
+				conn.Do("DEL", key)
+			}
+		})
+	}, true, nil
+}
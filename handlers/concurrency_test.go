@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+	other := courier.NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "AC", "2020", "US", nil)
+
+	rp := courier.NewMockBackend().RedisPool()
+	conn := rp.Get()
+	defer conn.Close()
+	conn.Do("DEL", inFlightPrefix+channel.UUID().String(), inFlightPrefix+other.UUID().String())
+
+	for _, pool := range []*redis.Pool{nil, rp} {
+		limiter := &ConcurrencyLimiter{}
+
+		// the first two requests are allowed, the third isn't while they're in flight
+		release1, allowed, err := limiter.Acquire(pool, channel, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		release2, allowed, err := limiter.Acquire(pool, channel, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		_, allowed, err = limiter.Acquire(pool, channel, 2)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+
+		// other channels have their own slots
+		releaseOther, allowed, err := limiter.Acquire(pool, other, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		releaseOther()
+
+		// releasing a slot lets another request in, releasing twice doesn't free two
+		release1()
+		release1()
+		release3, allowed, err := limiter.Acquire(pool, channel, 2)
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+		_, allowed, err = limiter.Acquire(pool, channel, 2)
+		assert.NoError(t, err)
+		assert.False(t, allowed)
+
+		release2()
+		release3()
+
+		// a limit of zero means no limit
+		for i := 0; i < 5; i++ {
+			release, allowed, err := limiter.Acquire(pool, channel, 0)
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+			release()
+		}
+	}
+
+	// limiters with a different key prefix count their slots in redis separately
+	limiter := &ConcurrencyLimiter{}
+	staging := &ConcurrencyLimiter{KeyPrefix: "staging:"}
+	conn.Do("DEL", "staging:"+inFlightPrefix+channel.UUID().String())
+	release, allowed, err := limiter.Acquire(rp, channel, 1)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	releaseStaging, allowed, err := staging.Acquire(rp, channel, 1)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	release()
+	releaseStaging()
+
+	// slots counted in process are forgotten once released
+	release, _, _ = limiter.Acquire(nil, channel, 2)
+	assert.Equal(t, 1, limiter.InFlight(channel))
+	release()
+	assert.Equal(t, 0, limiter.InFlight(channel))
+
+	// and those counted in redis expire in case their worker never releases them
+	limiter.Acquire(rp, channel, 2)
+	ttl, _ := redis.Int(conn.Do("TTL", inFlightPrefix+channel.UUID().String()))
+	assert.True(t, ttl > 0 && ttl <= inFlightTTL)
+
+	// and are never left counting below zero
+	conn.Do("DEL", inFlightPrefix+channel.UUID().String())
+	release, _, _ = limiter.Acquire(rp, channel, 2)
+	conn.Do("DEL", inFlightPrefix+channel.UUID().String())
+	release()
+	exists, _ := redis.Bool(conn.Do("EXISTS", inFlightPrefix+channel.UUID().String()))
+	assert.False(t, exists)
+}
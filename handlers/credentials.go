@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretsDir is the directory that ${SECRET:NAME} config values are read from, one file per secret
+var SecretsDir = "/run/secrets"
+
+// ConfigRefPrefixes are the prefixes the names of environment variables and secrets referenced by channel config must
+// start with, channel config can be edited by channel owners so they mustn't be able to read anything else
+var ConfigRefPrefixes = []string{"COURIER_HM_", "HORMUUD_"}
+
+var configRefRegex = regexp.MustCompile(`^\$\{(ENV|SECRET):([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// ResolveConfigValue resolves the passed in channel config value if it references a credential stored elsewhere, so
+// that secrets can be rotated without touching channel config. A value of ${ENV:NAME} resolves to the environment
+// variable NAME and one of ${SECRET:NAME} to the contents of the file NAME in SecretsDir.
+//
+// Only values which are a reference and nothing else are resolved, anything else, including values which contain a
+// reference alongside other text, is returned as the literal it is. A reference to a name which doesn't start with one
+// of ConfigRefPrefixes, or which can't be resolved, is an error rather than falling back to anything else.
+func ResolveConfigValue(value string) (string, error) {
+	match := configRefRegex.FindStringSubmatch(value)
+	if match == nil {
+		return value, nil
+	}
+
+	source, name := match[1], match[2]
+	if !isAllowedConfigRef(name) {
+		return "", errors.Errorf("%s is not an allowed reference, names must start with one of %s", name, strings.Join(ConfigRefPrefixes, ", "))
+	}
+
+	switch source {
+	case "ENV":
+		resolved, found := os.LookupEnv(name)
+		if !found || resolved == "" {
+			return "", errors.Errorf("environment variable %s is not set", name)
+		}
+		return resolved, nil
+
+	default:
+		contents, err := ioutil.ReadFile(filepath.Join(SecretsDir, name))
+		if err != nil {
+			return "", errors.Errorf("unable to read secret %s", name)
+		}
+
+		// secret files are usually written with a trailing newline which isn't part of the secret
+		resolved := strings.TrimRight(string(contents), "\r\n")
+		if resolved == "" {
+			return "", errors.Errorf("secret %s is empty", name)
+		}
+		return resolved, nil
+	}
+}
+
+// isAllowedConfigRef returns whether the passed in name starts with one of ConfigRefPrefixes
+func isAllowedConfigRef(name string) bool {
+	for _, prefix := range ConfigRefPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/nyaruka/gocommon/gsm7"
+)
+
+// GSM7Language is a national language whose shift tables, as defined in 3GPP TS 23.038, can be used to encode GSM7
+// messages containing characters which aren't in the default alphabet
+type GSM7Language string
+
+// the national languages we have shift tables for
+const (
+	GSM7Default    GSM7Language = ""
+	GSM7Turkish    GSM7Language = "tur"
+	GSM7Spanish    GSM7Language = "spa"
+	GSM7Portuguese GSM7Language = "por"
+)
+
+// the characters of the default extension table, each of which costs two septets
+const gsm7DefaultExtension = "\f^{}\\[~]|€"
+
+// gsm7ShiftTables are the characters of a language's locking shift table, which cost one septet, and single shift
+// table, which cost two. An empty locking shift table means the language uses the default alphabet.
+type gsm7ShiftTables struct {
+	id      byte
+	locking string
+	single  string
+}
+
+var gsm7LanguageTables = map[GSM7Language]gsm7ShiftTables{
+	GSM7Turkish: {
+		id:      1,
+		locking: "@£$¥€éùıòÇ\nĞğ\rÅåΔ_ΦΓΛΩΠΨΣΘΞŞşßÉ !\"#¤%&'()*+,-./0123456789:;<=>?İABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§çabcdefghijklmnopqrstuvwxyzäöñüà",
+		single:  "\f^{}\\[~]|ĞİŞç€ğış",
+	},
+	GSM7Spanish: {
+		id:     2,
+		single: "ç\f^{}\\[~]|ÁÍÓÚá€íóú",
+	},
+	GSM7Portuguese: {
+		id:      3,
+		locking: "@£$¥êéúíóç\nÔô\rÁáΔ_ªÇÀ∞^\\€Ó|ÂâÊÉ !\"#º%&'()*+,-./0123456789:;<=>?ÍABCDEFGHIJKLMNOPQRSTUVWXYZÃÕÚÜ§~abcdefghijklmnopqrstuvwxyzãõ`üà",
+		single:  "êç\fÔôÁáΔ_ΦΓ^ΩΠΨΣΘÊ{}\\[~]|ÀÍÓÚÃÕÂ€íóúãõâ",
+	},
+}
+
+// IsValid returns whether we have shift tables for this language
+func (l GSM7Language) IsValid() bool {
+	_, found := gsm7LanguageTables[l]
+	return l == GSM7Default || found
+}
+
+// ShiftTableID returns the identifier of this language used in the national language shift headers of messages
+func (l GSM7Language) ShiftTableID() byte {
+	return gsm7LanguageTables[l].id
+}
+
+// HasLockingShift returns whether this language has its own locking shift table rather than using the default alphabet
+func (l GSM7Language) HasLockingShift() bool {
+	return gsm7LanguageTables[l].locking != ""
+}
+
+// septets returns the number of septets the passed in character costs when encoded using this language's shift tables,
+// or zero if it can't be encoded with them
+func (l GSM7Language) septets(r rune) int {
+	tables := gsm7LanguageTables[l]
+
+	if tables.locking == "" {
+		if strings.ContainsRune(gsm7DefaultExtension, r) {
+			if tables.single == "" || strings.ContainsRune(tables.single, r) {
+				return 2
+			}
+		} else if gsm7.IsValid(string(r)) {
+			return 1
+		}
+	} else if strings.ContainsRune(tables.locking, r) {
+		return 1
+	}
+
+	if tables.single != "" && strings.ContainsRune(tables.single, r) {
+		return 2
+	}
+	return 0
+}
+
+// GSM7Septets returns the number of septets needed to encode the passed in text using the shift tables of the passed in
+// language, and whether it can be encoded with them at all
+func GSM7Septets(text string, language GSM7Language) (int, bool) {
+	total := 0
+	for _, r := range text {
+		septets := language.septets(r)
+		if septets == 0 {
+			return 0, false
+		}
+		total += septets
+	}
+	return total, true
+}
+
+// SplitMsgForLanguage splits the passed in text into parts which each need at most max septets when encoded using the
+// shift tables of the passed in language. Like SplitMsg we prefer to split on a space close to the end of a part. Nil
+// is returned if the text can't be encoded using the language's shift tables.
+func SplitMsgForLanguage(text string, max int, language GSM7Language) []string {
+	length, valid := GSM7Septets(text, language)
+	if !valid {
+		return nil
+	}
+
+	// smaller than our max, just return it
+	if length <= max {
+		return []string{text}
+	}
+
+	parts := make([]string, 0, 2)
+	part := bytes.Buffer{}
+	partLength := 0
+	for _, r := range text {
+		septets := language.septets(r)
+
+		// two septet characters can't be split across parts
+		if partLength+septets > max {
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+			partLength = 0
+		}
+
+		part.WriteRune(r)
+		partLength += septets
+
+		if partLength == max || (partLength > max-6 && r == ' ') {
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+			partLength = 0
+		}
+	}
+	if part.Len() > 0 {
+		parts = append(parts, strings.TrimSpace(part.String()))
+	}
+
+	return parts
+}
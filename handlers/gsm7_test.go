@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGSM7Septets(t *testing.T) {
+	tcs := []struct {
+		text     string
+		language GSM7Language
+		septets  int
+		valid    bool
+	}{
+		{"hello", GSM7Default, 5, true},
+		{"hello €", GSM7Default, 8, true},
+		{"Günaydın", GSM7Default, 0, false},
+		{"Günaydın", GSM7Turkish, 8, true},
+		{"Şeker €", GSM7Turkish, 7, true},
+		{"Şeker {}", GSM7Turkish, 10, true},
+		{"İstanbul", GSM7Turkish, 8, true},
+		{"ÆØ", GSM7Turkish, 0, false},
+		{"¡Hola! ¿Qué tal?", GSM7Default, 16, true},
+		{"¿Cómo estás?", GSM7Default, 0, false},
+		{"¿Cómo estás?", GSM7Spanish, 14, true},
+		{"Olá, tudo bem?", GSM7Portuguese, 14, true},
+		{"Não", GSM7Portuguese, 3, true},
+		{"☺", GSM7Turkish, 0, false},
+	}
+
+	for _, tc := range tcs {
+		septets, valid := GSM7Septets(tc.text, tc.language)
+		assert.Equal(t, tc.valid, valid, "unexpected valid for %s in %s", tc.text, tc.language)
+		assert.Equal(t, tc.septets, septets, "unexpected septets for %s in %s", tc.text, tc.language)
+	}
+}
+
+func TestGSM7Language(t *testing.T) {
+	assert.True(t, GSM7Default.IsValid())
+	assert.True(t, GSM7Turkish.IsValid())
+	assert.False(t, GSM7Language("xyz").IsValid())
+
+	assert.Equal(t, byte(1), GSM7Turkish.ShiftTableID())
+	assert.Equal(t, byte(2), GSM7Spanish.ShiftTableID())
+	assert.Equal(t, byte(3), GSM7Portuguese.ShiftTableID())
+
+	assert.True(t, GSM7Turkish.HasLockingShift())
+	assert.False(t, GSM7Spanish.HasLockingShift())
+	assert.True(t, GSM7Portuguese.HasLockingShift())
+}
+
+func TestSplitMsgForLanguage(t *testing.T) {
+	// 96 characters of Turkish which only fit a single part when using the Turkish tables
+	turkish := "Günaydın! Bugün hava çok güzel, dışarıda yürüyüş yapmak için harika bir gün. Şimdi çıkıyorum."
+	assert.Equal(t, []string{turkish}, SplitMsgForLanguage(turkish, 152, GSM7Turkish))
+	assert.Nil(t, SplitMsgForLanguage(turkish, 152, GSM7Default))
+
+	// we split on spaces close to the end of a part like SplitMsg
+	assert.Equal(t, []string{"Günaydın!", "Bugün hava", "çok güzel"}, SplitMsgForLanguage("Günaydın! Bugün hava çok güzel", 12, GSM7Turkish))
+
+	// two septet characters are never split across parts
+	assert.Equal(t, []string{"ab", "ç", "€", "€"}, SplitMsgForLanguage("abç€€", 3, GSM7Spanish))
+	assert.Equal(t, []string{"abc", "€€"}, SplitMsgForLanguage("abc€€", 4, GSM7Default))
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strings"
+)
+
+// VerifyHMAC returns whether the passed in signature is the HMAC of the passed in body using the passed in hash and
+// secret. Signatures can be hex or base64 encoded, and are compared in a way that isn't sensitive to timing attacks.
+func VerifyHMAC(h func() hash.Hash, secret string, body []byte, signature string) bool {
+	signature = strings.TrimSpace(signature)
+	if secret == "" || signature == "" {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	if actual, err := hex.DecodeString(signature); err == nil && hmac.Equal(expected, actual) {
+		return true
+	}
+	if actual, err := base64.StdEncoding.DecodeString(signature); err == nil && hmac.Equal(expected, actual) {
+		return true
+	}
+	return false
+}
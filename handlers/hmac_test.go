@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyHMAC(t *testing.T) {
+	body := []byte(`{"Sender": "+252612345678", "MessageText": "Join"}`)
+
+	// HMAC-SHA256 of our body with the secret sesame
+	hexSignature := "e4eaf09d957bde4bb7886c2d41d9df1b7007d819825003e4e4488874d51ff83b"
+
+	tcs := []struct {
+		secret    string
+		signature string
+		valid     bool
+	}{
+		{"sesame", hexSignature, true},
+		{"sesame", " " + hexSignature + " ", true},
+		{"sesame", "5OrwnZV73ku3iGwtQdnfG3AH2BmCUAPk5EiIdNUf+Ds=", true},
+		{"open", hexSignature, false},
+		{"sesame", hexSignature[:62], false},
+		{"sesame", "not a signature", false},
+		{"sesame", "", false},
+		{"", hexSignature, false},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.valid, VerifyHMAC(sha256.New, tc.secret, body, tc.signature), "valid mismatch for secret %s and signature %s", tc.secret, tc.signature)
+	}
+
+	// other hashes can be used
+	assert.False(t, VerifyHMAC(sha1.New, "sesame", body, hexSignature))
+}
@@ -3,26 +3,334 @@ package hormuud
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
+	"github.com/gofrs/uuid"
 	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/gsm7"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/nyaruka/librato"
+	"github.com/nyaruka/phonenumbers"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	configTokenURL          = "token_url"
+	configTokenTTL          = "token_ttl"
+	configTokenExpiryMargin = "token_expiry_margin"
+	configAllowEmpty        = "allow_empty_messages"
+	configMaxRate           = "max_rate"
+	configSenderIDs         = "sender_ids"
+	configAttachmentMode    = "attachment_mode"
+	configHTTPTimeout       = "http_timeout_seconds"
+	configAllowMissingID    = "allow_missing_message_id"
+	configLenientURN        = "lenient_urn"
+	configGSM7Language      = "gsm7_language"
+	configAuthHeader        = "auth_header"
+	configAuthScheme        = "auth_scheme"
+	configDryRun            = "dry_run"
+	configVerifyShortCode   = "verify_shortcode"
+	configBreakerThreshold  = "breaker_threshold"
+	configBreakerWindow     = "breaker_window_seconds"
+	configBreakerCooldown   = "breaker_cooldown_seconds"
+	configReferenceField    = "reference_field"
+	configPriority          = "priority"
+	configFlash             = "flash"
+	configMaxParts          = "max_parts"
+	configMaxPartsMode      = "max_parts_mode"
+	configForceEncoding     = "force_encoding"
+	configTemplate          = "template"
+	configSenderFormat      = "sender_format"
+	configBatchSend         = "batch_send"
+	configBatchSendURL      = "batch_send_url"
+	configBatchSize         = "batch_size"
+	configTransliterate     = "transliterate"
+	configIdempotencyField  = "idempotency_field"
+	configMediaMode         = "media_mode"
+	configSendAfter         = "send_after"
+	configScheduleField     = "schedule_field"
+	configCallbackSecret    = "callback_secret"
+	configSignatureHeader   = "callback_signature_header"
+	configSendURLFallback   = "send_url_fallback"
+	configCacheToken        = "cache_token"
+	configStopKeywords      = "stop_keywords"
+	configStartKeywords     = "start_keywords"
+	configSendRetries       = "send_retries"
+	configSendRetryDelay    = "send_retry_delay_ms"
+	configSenderType        = "sender_type"
+	configInterPartDelay    = "inter_part_delay_ms"
+	configFieldNames        = "field_names"
+	configMaxConcurrency    = "max_concurrency"
+	configConcurrencyMode   = "concurrency_mode"
+	configSendWindow        = "send_window"
+	configSendWindowTZ      = "send_window_timezone"
+	configLowBalance        = "low_balance_threshold"
+	configAllowedSenderIDs  = "allowed_sender_ids"
+	configMaxIncomingLength = "max_incoming_length"
+	configMaxIncomingMode   = "max_incoming_length_mode"
+	configPDUMode           = "pdu_mode"
+	configRouteKeywords     = "route_keywords"
+	configStatusDedupe      = "status_dedupe_seconds"
+	configMODedupe          = "mo_dedupe_seconds"
+	configClientCert        = "client_cert"
+	configClientKey         = "client_key"
+	configTLSMinVersion     = "tls_min_version"
+	configTLSInsecure       = "tls_insecure_skip_verify"
+	configValidity          = "validity_minutes"
+	configRefreshToken      = "use_refresh_token"
+	configHTTPProxy         = "http_proxy"
+	configTokenFormat       = "token_format"
+	configURNScheme         = "urn_scheme"
+	configRequestDLR        = "request_delivery_reports"
+	configTokenCharset      = "token_charset"
+	configCampaignField     = "campaign_field"
+)
+
+// the key of the message metadata holding the values substituted into the template of channels with a template config
+const metadataTemplateParams = "template_params"
+
+// the key of the message metadata flagging transactional messages, e.g. one time passwords, which are sent outside the
+// send_window of their channel
+const metadataTransactional = "transactional"
+
+// the key of the metadata of received messages holding which of their channel's route_keywords they start with
+const metadataKeyword = "keyword"
+
+// the key of the message metadata holding the time a message shouldn't be sent before, which overrides any send_after
+// config of its channel
+const metadataSendAfter = "send_after"
+
+// how we encode the messages we send, set by the force_encoding config, auto picks GSM7 if the text can be encoded with it
+const (
+	encodingAuto = "auto"
+	encodingGSM7 = "gsm7"
+	encodingUCS2 = "ucs2"
+)
+
+// how we interpret the senders of the messages we receive, set by the sender_format config, auto leaves it to the
+// phonenumbers library to work out whether they are international or local numbers
+const (
+	senderFormatAuto  = "auto"
+	senderFormatE164  = "e164"
+	senderFormatLocal = "local"
+)
+
+// how we tell Hormuud what type of sender id we send messages from, set by the sender_type config, auto picks numeric
+// for sender ids made up of only digits and alphanumeric otherwise
+const (
+	senderTypeAuto         = "auto"
+	senderTypeNumeric      = "numeric"
+	senderTypeAlphanumeric = "alphanumeric"
+)
+
+// where we count the sends in flight for channels with a max_concurrency, set by the concurrency_mode config, local
+// gives each worker its own share of sends while redis shares them across all workers
+const (
+	concurrencyModeLocal = "local"
+	concurrencyModeRedis = "redis"
+)
+
+// what we do with messages which split into more than max_parts parts, set by the max_parts_mode config
+const (
+	maxPartsModeTruncate = "truncate"
+	maxPartsModeFail     = "fail"
+)
+
+// what we do with received messages longer than max_incoming_length, set by the max_incoming_length_mode config
+const (
+	maxIncomingModeTruncate = "truncate"
+	maxIncomingModeReject   = "reject"
+)
+
+// how attachments are included in the messages we send, set by the attachment_mode config
+const (
+	attachmentModeInline = "inline"
+	attachmentModeDrop   = "drop"
+	attachmentModeFooter = "footer"
+)
+
+// how we encode the body of our token requests, set by the token_format config
+const (
+	tokenFormatForm = "form"
+	tokenFormatJSON = "json"
+)
+
+// the charsets we can encode the credentials of form encoded token requests in, set by the token_charset config
+const (
+	tokenCharsetUTF8   = "utf-8"
+	tokenCharsetLatin1 = "iso-8859-1"
+)
+
+// what we do with the media of incoming MMS messages, set by the media_mode config
+const (
+	mediaModeFetch       = "fetch"
+	mediaModePassthrough = "passthrough"
+)
+
 var (
-	maxMsgLength = 160
-	tokenURL     = "https://smsapi.hormuud.com/token"
-	sendURL      = "https://smsapi.hormuud.com/api/SendSMS"
+	defaultMaxMsgLength = 160
+	tokenURL            = "https://smsapi.hormuud.com/token"
+	sendURL             = "https://smsapi.hormuud.com/api/SendSMS"
+	batchSendURL        = "https://smsapi.hormuud.com/api/SendBulkSMS"
+
+	// the largest max_length we allow channels to configure, ten concatenated parts
+	maxConfigMsgLength = 1530
+
+	// the max length of each part of a message that needs to be sent as UCS-2
+	maxUnicodeMsgLength = 70
+
+	// how many characters the concatenation header takes away from each part of a multipart message
+	concatHeaderLength        = 7
+	unicodeConcatHeaderLength = 3
+
+	// the header Hormuud sends the signature of its callbacks in, unless channels configure otherwise
+	defaultSignatureHeader = "X-Hormuud-Signature"
+
+	// the prefix of the redis key we cache tokens under
+	tokenCachePrefix = "hm_token_"
+
+	// the description of the logs recording how many segments of each message we sent, so they can be reconciled
+	// against Hormuud's invoices
+	billingLogDescription = "Billing"
+
+	// what we tag the logs of requests which get us a new token with, so refreshes can be monitored
+	tokenRefreshedEvent       = "token_refreshed"
+	tokenRetrievedDescription = "Token Retrieved"
+
+	// how long we cache tokens for when the token response doesn't tell us
+	defaultTokenTTL = 5340
+
+	// how long we keep refresh tokens for when the token response doesn't tell us
+	defaultRefreshTokenTTL = 14 * 24 * 60 * 60
+
+	// how many seconds before a token's reported expiry we consider it stale
+	defaultTokenExpiryMargin = 60
+
+	// the header we send our token in and what we prefix it with, unless channels configure otherwise
+	defaultAuthHeader = "Authorization"
+	defaultAuthScheme = "Bearer "
+
+	// the prefix of the redis keys we buffer the parts of long incoming messages under, the suffixes of the keys we keep
+	// what we need to receive them under and remember which parts we received under once we have, and the key of the
+	// sorted set of buffers by when we stop waiting for the rest of their parts
+	moPartsPrefix         = "hm_mo_parts_"
+	moPartsInfoSuffix     = "_info"
+	moPartsReceivedSuffix = "_received"
+	moPartsPendingKey     = "hm_mo_parts_pending"
+
+	// how long we wait for all the parts of a long message before receiving what we have, how long we keep buffered
+	// parts in case nobody receives them in that time, how long we remember which parts we received after that, and how
+	// often we sweep for buffers we've waited on long enough
+	moPartsTimeout       = 30 * time.Second
+	moPartsBufferTTL     = 10 * time.Minute
+	moPartsReceivedTTL   = 10 * time.Minute
+	moPartsSweepInterval = 5 * time.Second
+
+	// channels opt in to a circuit breaker by setting breaker_threshold to how many consecutive send failures open it,
+	// each within breaker_window_seconds of the last, after which it stays open for breaker_cooldown_seconds. Without a
+	// threshold channels have no breaker and every send is attempted.
+	defaultBreakerThreshold = 0
+	defaultBreakerWindow    = 60
+	defaultBreakerCooldown  = 30
+
+	// reports how many seconds our send requests take, does nothing unless librato is configured
+	sendTimingGauge = librato.Gauge
+
+	// reports the balances of accounts, does nothing unless librato is configured
+	balanceGauge = librato.Gauge
+
+	// the prefix of the redis keys we remember the last balance reported for each channel under and for how long
+	balancePrefix = "hm_balance_"
+	balanceTTL    = 60 * 60 * 24 * 7
+
+	// what we tag the logs of balances falling to a channel's low_balance_threshold with, so they can be alerted on
+	lowBalanceEvent = "low_balance"
+
+	// the prefix of the synthetic message ids we give messages sent in dry runs
+	dryRunIDPrefix = "dryrun_"
+
+	// how many milliseconds we wait before retrying a failed send for channels with send_retries unless they configure
+	// otherwise, doubling before each further retry, and the most retries channels can configure
+	defaultSendRetryDelay = 500
+	maxSendRetries        = 5
+
+	// the longest inter_part_delay_ms channels can configure
+	maxInterPartDelay = 10000
+
+	// the longest validity_minutes messages can have, a week
+	maxValidity = 60 * 24 * 7
+
+	// the largest http_timeout_seconds channels can configure, our shared HTTP client never waits longer than this
+	maxHTTPTimeout = 60
+
+	// matches everything in a number that isn't a digit
+	nonDigitsRegex = regexp.MustCompile(`[^0-9]`)
+
+	// matches numbers made up of only digits and the punctuation people format them with
+	mobileCharsRegex = regexp.MustCompile(`^\+?[0-9 ()\-.]+$`)
+
+	// the note we add to messages with attachments in footer mode
+	attachmentFooter = "[media not supported]"
+
+	// the prefix of the redis key we map the message ids of later parts of multipart messages to the first under
+	partIDCachePrefix = "hm_part_"
+
+	// how long we remember those mappings, long enough for any delivery reports to arrive
+	partIDTTL = 60 * 60 * 24 * 7
+
+	// the prefix of the redis keys we remember the delivery reports we've received under, and for how many seconds
+	// unless channels configure otherwise
+	statusSeenPrefix    = "hm_status_seen_"
+	defaultStatusDedupe = 60 * 60
+
+	// the prefix of the redis keys we remember the messages we've received under, and for how many seconds unless
+	// channels configure otherwise
+	moSeenPrefix    = "hm_mo_seen_"
+	defaultMODedupe = 60 * 60 * 24
+
+	// the fraction of a token's TTL we randomly take off it and the source of randomness we do it with
+	tokenTTLJitter = 0.05
+	randFloat      = rand.Float64
+
+	// how long we wait for more messages with the same text before sending a batch, how we schedule sending them, and
+	// how many destinations we send in one batch unless channels configure otherwise
+	afterFunc        = time.AfterFunc
+	batchWait        = 250 * time.Millisecond
+	defaultBatchSize = 100
+
+	// the largest TimeSent we treat as seconds, anything larger is in milliseconds
+	maxSecondsTimestamp int64 = 1e12
+
+	// the prefixes of the redis keys we mark channels as backing off from token requests under and count their
+	// consecutive token request failures under
+	tokenBackoffPrefix  = "hm_token_backoff_"
+	tokenFailuresPrefix = "hm_token_failures_"
+
+	// how many seconds we back off for after our first failed token request, doubling with each further failure
+	minTokenBackoff = 2
+	maxTokenBackoff = 300
 )
 
 func init() {
@@ -31,16 +339,41 @@ func init() {
 
 type handler struct {
 	handlers.BaseHandler
+
+	// the batches of messages currently waiting to be sent together, keyed by channel and what we're sending
+	batches      map[string]*sendBatch
+	batchesMutex sync.Mutex
+
+	// the max length of each message part for channels which don't configure their own, handlers built on this one for
+	// resellers with different limits can set their own, zero means our default
+	msgLength int
+
+	// the sends in flight for each channel with a max_concurrency which counts them locally
+	inFlight handlers.ConcurrencyLimiter
 }
 
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("HM"), "Hormuud")}
+	return &handler{BaseHandler: handlers.NewBaseHandler(courier.ChannelType("HM"), "Hormuud")}
+}
+
+// maxMsgLength returns the max length of each message part for channels which don't configure their own
+func (h *handler) maxMsgLength() int {
+	if h.msgLength > 0 {
+		return h.msgLength
+	}
+	return defaultMaxMsgLength
 }
 
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
+	h.inFlight.KeyPrefix = h.RedisKeyPrefix()
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
+	s.AddHandlerRoute(h, http.MethodPost, "status", h.receiveStatus)
+
+	// whichever of our instances gets to it first receives the long messages we've stopped waiting for the rest of
+	s.WaitGroup().Add(1)
+	go h.sweepPartsLoop(s)
 	return nil
 }
 
@@ -49,158 +382,3100 @@ type moPayload struct {
 	MessageText string
 	ShortCode   string `validate:"required"`
 	TimeSent    int64  `validate:"required"`
+	MessageID   string
+	PartRef     string
+	PartTotal   int
+	PartSeq     int
+	MediaURL    string
+	MediaType   string
+}
+
+// isPart returns whether this is one part of a long message which Hormuud delivers to us in several requests
+func (p *moPayload) isPart() bool {
+	return p.PartRef != "" && p.PartTotal > 1 && p.PartSeq >= 1 && p.PartSeq <= p.PartTotal
+}
+
+// dedupeKey returns what we dedupe this message by, which is the id Hormuud gave it if it has one, otherwise a
+// fingerprint of its contents since retries of the same delivery will be identical
+func (p *moPayload) dedupeKey() string {
+	if p.MessageID != "" {
+		return p.MessageID
+	}
+
+	fingerprint := fmt.Sprintf("%s|%s|%d|%s", p.Sender, p.ShortCode, p.TimeSent, p.MessageText)
+	if p.MediaURL != "" {
+		fingerprint += "|" + p.MediaURL
+	}
+
+	hash := sha1.Sum([]byte(fingerprint))
+	return hex.EncodeToString(hash[:])
 }
 
 // receiveMessage is our HTTP handler function for incoming messages
 func (h *handler) receiveMessage(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := verifyCallback(c, r); err != nil {
+		return nil, courier.WriteAndLogForbidden(ctx, w, r, c, err)
+	}
+
 	payload := &moPayload{}
-	err := handlers.DecodeAndValidateForm(payload, r)
+
+	// newer Hormuud webhooks post their payload as JSON, older ones as a form
+	var err error
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		err = handlers.DecodeAndValidateJSON(payload, r)
+	} else {
+		err = handlers.DecodeAndValidateForm(payload, r)
+	}
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
 	}
 
+	// channels can insist that messages were sent to their own shortcode so misrouted webhooks are rejected
+	if c.BoolConfigForKey(configVerifyShortCode, false) && strings.TrimPrefix(payload.ShortCode, "+") != strings.TrimPrefix(c.Address(), "+") {
+		logrus.WithField("channel_uuid", c.UUID()).WithField("shortcode", payload.ShortCode).WithField("address", c.Address()).Warn("rejected HM message sent to another shortcode")
+		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, errors.Errorf("shortcode '%s' does not match channel address", payload.ShortCode))
+	}
+
+	// empty messages are ignored unless this channel explicitly wants them, messages with media aren't empty
+	if strings.TrimSpace(payload.MessageText) == "" && payload.MediaURL == "" && !c.BoolConfigForKey(configAllowEmpty, false) {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, "ignoring empty message")
+	}
+
 	// create our date from the timestamp
-	date := time.Unix(payload.TimeSent, 0).UTC()
+	date := parseTimeSent(payload.TimeSent)
+
+	urn, err := urnForSender(c, payload.Sender)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+	}
+
+	// parts of long messages are buffered until we have them all, then received as a single message
+	if payload.isPart() && h.Backend().RedisPool() != nil {
+		text, complete, err := h.bufferPart(c, urn, date, payload)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+		}
+		if !complete {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, fmt.Sprintf("buffered part %d of %d", payload.PartSeq, payload.PartTotal))
+		}
+
+		payload = &moPayload{Sender: payload.Sender, ShortCode: payload.ShortCode, TimeSent: payload.TimeSent, MessageText: text, MediaURL: payload.MediaURL, MediaType: payload.MediaType}
+	}
+
+	// malformed callbacks can carry enormous texts, which channels can limit the length of rather than store them
+	if maxLength := c.IntConfigForKey(configMaxIncomingLength, 0); maxLength > 0 && utf8.RuneCountInString(payload.MessageText) > maxLength {
+		log := logrus.WithField("channel_uuid", c.UUID()).WithField("length", utf8.RuneCountInString(payload.MessageText)).WithField("max_length", maxLength)
 
-	urn, err := handlers.StrictTelForCountry(payload.Sender, c.Country())
+		if c.StringConfigForKey(configMaxIncomingMode, maxIncomingModeTruncate) == maxIncomingModeReject {
+			log.Warn("rejected HM message which is too long")
+			return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, errors.Errorf("message is longer than the maximum of %d characters", maxLength))
+		}
+
+		log.Warn("truncating HM message which is too long")
+		payload.MessageText = string([]rune(payload.MessageText)[:maxLength])
+	}
+
+	// Hormuud retries deliveries it thinks timed out, which we accept as before without writing them again
+	seen, err := h.markMsgSeen(c, payload)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", c.UUID()).Error("error checking for duplicate HM message")
+	}
+
+	// messages which are just one of the channel's stop or start keywords opt the contact out or back in
+	if eventType, found := keywordEventType(c, payload.MessageText); found {
+		event := h.Backend().NewChannelEvent(c, eventType, urn).WithOccurredOn(date)
+		if seen {
+			return nil, courier.WriteChannelEventSuccess(ctx, w, r, event)
+		}
+		if err := h.Backend().WriteChannelEvent(ctx, event); err != nil {
+			// we didn't write this event so shouldn't ignore Hormuud retrying it
+			h.forgetMsgSeen(c, payload)
+			return nil, err
+		}
+		return []courier.Event{event}, courier.WriteChannelEventSuccess(ctx, w, r, event)
+	}
+
+	attachment, err := attachmentForPayload(c, payload)
 	if err != nil {
+		h.forgetMsgSeen(c, payload)
 		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
 	}
 
 	msg := h.Backend().NewIncomingMsg(c, urn, payload.MessageText).WithReceivedOn(date)
-	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if payload.MessageID != "" {
+		msg.WithExternalID(payload.MessageID)
+	}
+	if attachment != "" {
+		msg.WithAttachment(attachment)
+	}
+
+	// shared shortcodes can tag messages with their leading keyword so that flows can route them
+	if keyword, found := routeKeyword(c, payload.MessageText); found {
+		metadata, _ := json.Marshal(map[string]string{metadataKeyword: keyword})
+		msg.WithMetadata(metadata)
+	}
+
+	if seen {
+		return nil, h.WriteMsgSuccessResponse(ctx, w, r, []courier.Msg{msg})
+	}
+
+	events, err := handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	if err != nil {
+		// we didn't queue this message so shouldn't ignore Hormuud retrying it
+		h.forgetMsgSeen(c, payload)
+	}
+	return events, err
 }
 
-type mtPayload struct {
-	Mobile   string `json:"mobile"`
-	Message  string `json:"message"`
-	SenderID string `json:"senderid"`
-	MType    int    `json:"mType"`
-	EType    int    `json:"eType"`
-	UDH      string `json:"UDH"`
+// markMsgSeen records that we've received the passed in message, returning whether we already had within the
+// mo_dedupe_seconds of the channel. Channels with a window of zero or less don't dedupe messages.
+func (h *handler) markMsgSeen(c courier.Channel, payload *moPayload) (bool, error) {
+	window := c.IntConfigForKey(configMODedupe, defaultMODedupe)
+	rp := h.Backend().RedisPool()
+	if window <= 0 || rp == nil {
+		return false, nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", h.msgSeenKey(c, payload), "1", "EX", window, "NX"))
+	if err == redis.ErrNil {
+		return true, nil
+	}
+	return false, err
 }
 
-// SendMsg sends the passed in message, returning any error
-func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
-	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+// forgetMsgSeen forgets that we've received the passed in message
+func (h *handler) forgetMsgSeen(c courier.Channel, payload *moPayload) {
+	rp := h.Backend().RedisPool()
+	if rp == nil {
+		return
+	}
 
-	token, rr, err := h.FetchToken(ctx, msg.Channel(), msg)
-	if rr == nil && err != nil {
-		return nil, errors.Wrapf(err, "unable to fetch token")
+	conn := rp.Get()
+	defer conn.Close()
+
+	conn.Do("DEL", h.msgSeenKey(c, payload))
+}
+
+func (h *handler) msgSeenKey(c courier.Channel, payload *moPayload) string {
+	return fmt.Sprintf("%s%s%s_%s", h.RedisKeyPrefix(), moSeenPrefix, c.UUID(), payload.dedupeKey())
+}
+
+// keywordEventType returns the type of channel event the passed in message text triggers if, ignoring case and
+// surrounding whitespace, it is one of the channel's stop_keywords or start_keywords
+func keywordEventType(c courier.Channel, text string) (courier.ChannelEventType, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", false
 	}
 
-	// if we made a request for our token, stash that in our status
-	if rr != nil {
-		log := courier.NewChannelLogFromRR("Token Retrieved", msg.Channel(), msg.ID(), rr).WithError("Token Retrieval Error", err)
-		status.AddLog(log)
+	for _, keyword := range listForChannel(c, configStopKeywords) {
+		if strings.EqualFold(keyword, text) {
+			return courier.StopContact, true
+		}
+	}
+	for _, keyword := range listForChannel(c, configStartKeywords) {
+		if strings.EqualFold(keyword, text) {
+			return courier.StartContact, true
+		}
 	}
+	return "", false
+}
 
-	// failed getting a token? we are done
+// routeKeyword returns which of the channel's route_keywords the passed in message text starts with, ignoring case
+func routeKeyword(c courier.Channel, text string) (string, bool) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return "", false
+	}
+
+	for _, keyword := range listForChannel(c, configRouteKeywords) {
+		if strings.EqualFold(keyword, words[0]) {
+			return keyword, true
+		}
+	}
+	return "", false
+}
+
+// listForChannel returns the values configured for the passed in channel with the passed in key, e.g. its stop
+// keywords, which may be configured either as a list or a comma separated string
+func listForChannel(c courier.Channel, key string) []string {
+	var values []string
+
+	switch config := c.ConfigForKey(key, nil).(type) {
+	case []string:
+		values = config
+	case []interface{}:
+		for _, value := range config {
+			if valueStr, isStr := value.(string); isStr {
+				values = append(values, valueStr)
+			}
+		}
+	case string:
+		values = strings.Split(config, ",")
+	}
+
+	trimmed := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			trimmed = append(trimmed, value)
+		}
+	}
+	return trimmed
+}
+
+// verifyCallback checks the signature of the passed in callback from Hormuud, which is the hex or base64 encoded
+// HMAC-SHA256 of its body using the channel's callback_secret. Channels without a secret don't verify callbacks.
+func verifyCallback(c courier.Channel, r *http.Request) error {
+	secret := c.StringConfigForKey(configCallbackSecret, "")
+	if secret == "" {
+		return nil
+	}
+
+	signature := r.Header.Get(c.StringConfigForKey(configSignatureHeader, defaultSignatureHeader))
+	if signature == "" {
+		return errors.Errorf("missing request signature")
+	}
+
+	body, err := handlers.ReadBody(r, 100000)
 	if err != nil {
-		return status, nil
+		return errors.Wrapf(err, "unable to read request body")
 	}
 
-	parts := handlers.SplitMsgByChannel(msg.Channel(), handlers.GetTextAndAttachments(msg), maxMsgLength)
-	for i, part := range parts {
-		payload := &mtPayload{}
-		payload.Mobile = strings.TrimPrefix(msg.URN().Path(), "+")
-		payload.Message = part
-		payload.SenderID = msg.Channel().Address()
-		payload.MType = -1
-		payload.EType = -1
-		payload.UDH = ""
+	if !handlers.VerifyHMAC(sha256.New, secret, body, strings.TrimPrefix(signature, "sha256=")) {
+		return errors.Errorf("invalid request signature")
+	}
+	return nil
+}
 
-		requestBody := &bytes.Buffer{}
-		json.NewEncoder(requestBody).Encode(payload)
+// attachmentForPayload returns the attachment for the media of the passed in MMS message, if it has any. By default
+// this is the media URL which the backend fetches and stores, but channels can set media_mode to passthrough to have
+// the URL stored as it is, prefixed with its content type.
+func attachmentForPayload(c courier.Channel, payload *moPayload) (string, error) {
+	if payload.MediaURL == "" {
+		return "", nil
+	}
 
-		// build our request
-		req, err := http.NewRequest(http.MethodPost, sendURL, requestBody)
-		if err != nil {
-			return nil, err
+	mediaURL, err := url.Parse(payload.MediaURL)
+	if err != nil || (mediaURL.Scheme != "http" && mediaURL.Scheme != "https") || mediaURL.Host == "" {
+		return "", errors.Errorf("invalid media URL '%s'", payload.MediaURL)
+	}
+
+	mode := c.StringConfigForKey(configMediaMode, mediaModeFetch)
+	switch mode {
+	case mediaModePassthrough:
+		mediaType := payload.MediaType
+		if mediaType == "" {
+			mediaType = mime.TypeByExtension(path.Ext(mediaURL.Path))
+		}
+		if mediaType == "" {
+			mediaType = "application/octet-stream"
 		}
+		if i := strings.Index(mediaType, ";"); i >= 0 {
+			mediaType = strings.TrimSpace(mediaType[:i])
+		}
+		return mediaType + ":" + payload.MediaURL, nil
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	case mediaModeFetch:
+		return payload.MediaURL, nil
 
-		rr, err := utils.MakeHTTPRequest(req)
-		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
-		status.AddLog(log)
+	default:
+		logrus.WithField("channel_uuid", c.UUID()).WithField("media_mode", mode).Warn("invalid HM media mode, fetching media")
+		return payload.MediaURL, nil
+	}
+}
+
+// partsInfo is what we keep about a long message whose parts we're buffering so that any of our instances can receive
+// it without them all
+type partsInfo struct {
+	ChannelUUID string    `json:"channel_uuid"`
+	URN         urns.URN  `json:"urn"`
+	ReceivedOn  time.Time `json:"received_on"`
+}
+
+// bufferPart adds the passed in part of a long message to those we have buffered in Redis. If that completes the
+// message, or we've waited long enough for the rest of its parts, its parts are removed from the buffer and the text
+// of the whole message is returned. Buffers which don't get any more parts once we've stopped waiting are received by
+// sweepParts instead.
+//
+// Parts arriving after their message has been received are returned as complete messages on their own, unless they are
+// retries of parts we've already received which are ignored.
+func (h *handler) bufferPart(c courier.Channel, urn urns.URN, date time.Time, payload *moPayload) (string, bool, error) {
+	conn := h.Backend().RedisPool().Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s%s%s_%s_%s", h.RedisKeyPrefix(), moPartsPrefix, c.UUID(), payload.Sender, payload.PartRef)
+	seq := strconv.Itoa(payload.PartSeq)
+
+	received, included, err := partReceived(conn, key, seq)
+	if err != nil {
+		return "", false, err
+	}
+	if received {
+		if included {
+			return "", false, nil
+		}
+		return payload.MessageText, true, nil
+	}
+
+	_, err = conn.Do("HSET", key, seq, payload.MessageText)
+	if err == nil {
+		_, err = conn.Do("EXPIRE", key, int(moPartsBufferTTL/time.Second))
+	}
+	var buffered int
+	if err == nil {
+		buffered, err = redis.Int(conn.Do("HLEN", key))
+	}
+	if err == nil && buffered == 1 {
+		info, _ := json.Marshal(&partsInfo{ChannelUUID: c.UUID().String(), URN: urn, ReceivedOn: date})
+		_, err = conn.Do("SET", key+moPartsInfoSuffix, info, "EX", int(moPartsBufferTTL/time.Second), "NX")
+		if err == nil {
+			_, err = conn.Do("ZADD", h.partsPendingKey(), "NX", unixMillis(time.Now().Add(moPartsTimeout)), key)
+		}
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "error buffering message part")
+	}
+
+	if buffered < payload.PartTotal {
+		// we may have stopped waiting for the rest of this message's parts without it being swept yet
+		deadline, err := redis.Int64(conn.Do("ZSCORE", h.partsPendingKey(), key))
+		if err == redis.ErrNil || (err == nil && deadline > unixMillis(time.Now())) {
+			return "", false, nil
+		}
 		if err != nil {
-			return status, nil
+			return "", false, errors.Wrapf(err, "error checking for message parts deadline")
 		}
-		status.SetStatus(courier.MsgWired)
+	}
+
+	text, claimed, err := claimParts(conn, key)
+	if err != nil {
+		return "", false, err
+	}
 
-		// try to get the message id out
-		id, _ := jsonparser.GetString(rr.Body, "Data", "MessageID")
-		if id != "" && i == 0 {
-			status.SetExternalID(id)
+	// somebody else received the message while we were buffering our part, if it didn't include our part then we
+	// receive it on its own
+	if !claimed {
+		_, included, err := partReceived(conn, key, seq)
+		if err != nil || included {
+			return "", false, err
 		}
+
+		conn.Do("HDEL", key, seq)
+		return payload.MessageText, true, nil
 	}
 
-	return status, nil
+	h.removeParts(conn, key)
+	if buffered < payload.PartTotal {
+		logrus.WithField("channel_uuid", c.UUID()).WithField("part_ref", payload.PartRef).Info("receiving HM message without all its parts")
+	}
+	return text, true, nil
 }
 
-type tokenResponse struct {
-	AccessToken string `json:"access_token" validate:"required"`
+// partReceived returns whether the message whose parts are buffered under the passed in key has been received, and if
+// so whether the part with the passed in sequence number was included in it
+func partReceived(conn redis.Conn, key string, seq string) (bool, bool, error) {
+	received, err := redis.String(conn.Do("GET", key+moPartsReceivedSuffix))
+	if err == redis.ErrNil {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, errors.Wrapf(err, "error checking for received message parts")
+	}
+
+	for _, receivedSeq := range strings.Split(received, ",") {
+		if receivedSeq == seq {
+			return true, true, nil
+		}
+	}
+	return true, false, nil
 }
 
-// FetchToken gets the current token for this channel, either from Redis if cached or by requesting it
-func (h *handler) FetchToken(ctx context.Context, channel courier.Channel, msg courier.Msg) (string, *utils.RequestResponse, error) {
-	// first check whether we have it in redis
-	conn := h.Backend().RedisPool().Get()
-	token, err := redis.String(conn.Do("GET", fmt.Sprintf("hm_token_%s", channel.UUID())))
-	conn.Close()
+// sweepPartsLoop sweeps for the long messages we've stopped waiting for the rest of the parts of until the passed in
+// server is stopped
+func (h *handler) sweepPartsLoop(s courier.Server) {
+	defer s.WaitGroup().Done()
+
+	for {
+		select {
+		case <-s.StopChan():
+			return
+
+		case <-time.After(moPartsSweepInterval):
+			ctx, cancel := context.WithTimeout(context.Background(), moPartsSweepInterval)
+			if _, err := h.sweepParts(ctx, time.Now()); err != nil {
+				logrus.WithError(err).Error("error sweeping HM message parts")
+			}
+			cancel()
+		}
+	}
+}
 
-	// got a token, use it
-	if token != "" {
-		return token, nil, nil
+// sweepParts receives the long messages whose deadlines for the rest of their parts are before the passed in time as
+// whatever parts we have, returning how many it received
+func (h *handler) sweepParts(ctx context.Context, now time.Time) (int, error) {
+	rp := h.Backend().RedisPool()
+	if rp == nil {
+		return 0, nil
 	}
 
-	// no token, lets go fetch one
-	username := channel.StringConfigForKey(courier.ConfigUsername, "")
-	if username == "" {
-		return "", nil, fmt.Errorf("Missing 'username' config for HM channel")
+	conn := rp.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", h.partsPendingKey(), "-inf", unixMillis(now), "LIMIT", 0, 100))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading pending message parts")
 	}
 
-	password := channel.StringConfigForKey(courier.ConfigPassword, "")
-	if password == "" {
-		return "", nil, fmt.Errorf("Missing 'password' config for HM channel")
+	swept := 0
+	for _, key := range keys {
+		received, err := h.flushParts(ctx, conn, key)
+		if err != nil {
+			logrus.WithError(err).WithField("parts_key", key).Error("error flushing HM message parts")
+			continue
+		}
+		if received {
+			swept++
+		}
 	}
+	return swept, nil
+}
 
-	form := url.Values{
-		"Username":   []string{username},
-		"Password":   []string{password},
-		"grant_type": []string{"password"},
+// flushParts receives whatever parts of a long message are buffered under the passed in key as they are, returning
+// whether we received them. If we can't write the message its parts are kept for a later sweep to try again.
+func (h *handler) flushParts(ctx context.Context, conn redis.Conn, key string) (bool, error) {
+	raw, err := redis.Bytes(conn.Do("GET", key+moPartsInfoSuffix))
+	if err == redis.ErrNil {
+		// these parts have expired, there's nothing left to receive
+		h.removeParts(conn, key)
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading message parts info")
 	}
 
-	// build our request
-	req, _ := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Accept", "application/json")
+	info := &partsInfo{}
+	if err := json.Unmarshal(raw, info); err != nil {
+		h.removeParts(conn, key)
+		return false, errors.Wrapf(err, "error parsing message parts info")
+	}
 
-	rr, err := utils.MakeHTTPRequest(req)
+	channelUUID, err := courier.NewChannelUUID(info.ChannelUUID)
+	if err != nil {
+		h.removeParts(conn, key)
+		return false, errors.Wrapf(err, "invalid channel uuid for message parts")
+	}
+	channel, err := h.Backend().GetChannel(ctx, h.ChannelType(), channelUUID)
+	if err == courier.ErrChannelNotFound {
+		h.removeParts(conn, key)
+		return false, nil
+	}
 	if err != nil {
-		return "", rr, errors.Wrapf(err, "error making token request")
+		return false, errors.Wrapf(err, "error looking up channel for message parts")
 	}
 
-	token, err = jsonparser.GetString(rr.Body, "access_token")
+	text, claimed, err := claimParts(conn, key)
 	if err != nil {
-		return "", rr, errors.Wrapf(err, "error getting access_token from response")
+		return false, err
+	}
+	if !claimed {
+		// somebody else already received these parts
+		conn.Do("ZREM", h.partsPendingKey(), key)
+		return false, nil
 	}
 
-	if token == "" {
-		return "", rr, errors.Errorf("no access token returned")
+	msg := h.Backend().NewIncomingMsg(channel, info.URN, text).WithReceivedOn(info.ReceivedOn)
+	if err := h.Backend().WriteMsg(ctx, msg); err != nil {
+		conn.Do("DEL", key+moPartsReceivedSuffix)
+		conn.Do("ZADD", h.partsPendingKey(), unixMillis(time.Now().Add(moPartsSweepInterval)), key)
+		return false, errors.Wrapf(err, "error writing partial HM message")
 	}
 
-	// we got a token, cache it to redis with a 90 minute expiration
-	conn = h.Backend().RedisPool().Get()
-	_, err = conn.Do("SETEX", fmt.Sprintf("hm_token_%s", channel.UUID()), 5340, token)
-	conn.Close()
+	h.removeParts(conn, key)
+	logrus.WithField("channel_uuid", channel.UUID()).WithField("msg_uuid", msg.UUID()).Info("received HM message without all its parts")
+	return true, nil
+}
 
+// claimParts returns the text of the parts buffered under the passed in key in order, remembering which parts they
+// were. Only one caller can claim a message's parts, anybody else gets false. Claimed parts are kept until they're
+// removed with removeParts, so that they can be given back if we fail to receive them.
+func claimParts(conn redis.Conn, key string) (string, bool, error) {
+	parts, err := redis.StringMap(conn.Do("HGETALL", key))
 	if err != nil {
-		logrus.WithError(err).Error("error caching HM access token")
+		return "", false, errors.Wrapf(err, "error reading message parts")
+	}
+	if len(parts) == 0 {
+		return "", false, nil
 	}
 
-	return token, rr, nil
+	seqs := make([]int, 0, len(parts))
+	for seq := range parts {
+		n, _ := strconv.Atoi(seq)
+		seqs = append(seqs, n)
+	}
+	sort.Ints(seqs)
+
+	received := make([]string, len(seqs))
+	for i, seq := range seqs {
+		received[i] = strconv.Itoa(seq)
+	}
+
+	// remember which parts we received so we can tell retries from stragglers
+	_, err = redis.String(conn.Do("SET", key+moPartsReceivedSuffix, strings.Join(received, ","), "EX", int(moPartsReceivedTTL/time.Second), "NX"))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "error claiming message parts")
+	}
+
+	text := &strings.Builder{}
+	for _, seq := range received {
+		text.WriteString(parts[seq])
+	}
+	return text.String(), true, nil
+}
+
+// removeParts removes the parts buffered under the passed in key, along with what we kept to receive them
+func (h *handler) removeParts(conn redis.Conn, key string) {
+	conn.Send("MULTI")
+	conn.Send("DEL", key, key+moPartsInfoSuffix)
+	conn.Send("ZREM", h.partsPendingKey(), key)
+	if _, err := conn.Do("EXEC"); err != nil {
+		logrus.WithError(err).WithField("parts_key", key).Error("error removing HM message parts")
+	}
+}
+
+func (h *handler) partsPendingKey() string {
+	return h.RedisKeyPrefix() + moPartsPendingKey
+}
+
+// unixMillis returns the passed in time as milliseconds since the epoch
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// senderForFormat returns the passed in sender as we want to parse it given the sender format of the passed in channel.
+// Shortcodes which send E.164 numbers don't always include the leading +, and those which send local numbers might
+// send ones which look like they already start with a country code, so we don't leave either to chance.
+func senderForFormat(channel courier.Channel, sender string) string {
+	format := channel.StringConfigForKey(configSenderFormat, senderFormatAuto)
+	switch format {
+	case senderFormatAuto:
+		return sender
+
+	case senderFormatE164:
+		return "+" + nonDigitsRegex.ReplaceAllString(sender, "")
+
+	case senderFormatLocal:
+		countryCode := phonenumbers.GetCountryCodeForRegion(channel.Country())
+		digits := strings.TrimLeft(nonDigitsRegex.ReplaceAllString(sender, ""), "0")
+		if countryCode == 0 || digits == "" {
+			return sender
+		}
+		return fmt.Sprintf("+%d%s", countryCode, digits)
+
+	default:
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("sender_format", format).Warn("invalid sender_format for HM channel, using auto")
+		return sender
+	}
+}
+
+// urnForSender returns the URN of the passed in sender of a message received on the passed in channel. Senders are
+// phone numbers unless the channel's urn_scheme says they are ids of its shortcode product's own, e.g. anonymized
+// subscriber ids, which are received as external ids.
+func urnForSender(channel courier.Channel, sender string) (urns.URN, error) {
+	switch scheme := channel.StringConfigForKey(configURNScheme, urns.TelScheme); scheme {
+	case urns.TelScheme:
+		urn, err := handlers.StrictTelForCountry(senderForFormat(channel, sender), channel.Country())
+		if err != nil && channel.BoolConfigForKey(configLenientURN, false) {
+			urn, err = lenientTelForCountry(channel, sender, err)
+		}
+		return urn, err
+
+	case urns.ExternalScheme:
+		return urns.NewURNFromParts(urns.ExternalScheme, strings.TrimSpace(sender), "", "")
+
+	default:
+		return urns.NilURN, errors.Errorf("unsupported urn_scheme '%s' for HM channel", scheme)
+	}
+}
+
+// lenientTelForCountry tries to salvage a sender number that StrictTelForCountry rejected by treating its digits as a
+// local number in the channel's country. If that doesn't work either, the original error is returned.
+func lenientTelForCountry(channel courier.Channel, number string, strictErr error) (urns.URN, error) {
+	countryCode := phonenumbers.GetCountryCodeForRegion(channel.Country())
+	digits := strings.TrimLeft(nonDigitsRegex.ReplaceAllString(number, ""), "0")
+	if countryCode == 0 || digits == "" {
+		return urns.NilURN, strictErr
+	}
+
+	// don't add the country code if the number already starts with it
+	prefix := strconv.Itoa(countryCode)
+	if !strings.HasPrefix(digits, prefix) {
+		digits = prefix + digits
+	}
+
+	urn, err := handlers.StrictTelForCountry("+"+digits, channel.Country())
+	if err != nil {
+		return urns.NilURN, strictErr
+	}
+
+	logrus.WithField("channel_uuid", channel.UUID()).WithField("sender", number).WithField("urn", urn).Info("applied lenient URN normalization to HM sender")
+	return urn, nil
+}
+
+// parseTimeSent converts the passed in TimeSent to a time, treating values too large to be seconds as milliseconds
+// since some shortcodes send those instead
+func parseTimeSent(timeSent int64) time.Time {
+	if timeSent > maxSecondsTimestamp {
+		return time.Unix(0, timeSent*int64(time.Millisecond)).UTC()
+	}
+	return time.Unix(timeSent, 0).UTC()
+}
+
+type statusPayload struct {
+	MessageID string `validate:"required"`
+	Status    string `validate:"required"`
+}
+
+// statusMapping maps the numeric DLR codes of Hormuud's delivery reports to our statuses. Intermediate states, where
+// the message is still on its way to the handset, are sent rather than delivered and can be followed by a final state.
+// Codes which aren't listed here don't update the status of the message.
+var statusMapping = map[string]courier.MsgStatusValue{
+	"1":  courier.MsgDelivered, // delivered to the handset
+	"2":  courier.MsgFailed,    // undeliverable to the handset
+	"4":  courier.MsgSent,      // accepted and queued by the SMSC
+	"8":  courier.MsgSent,      // en route, delivered to the SMSC
+	"16": courier.MsgFailed,    // rejected by the SMSC
+}
+
+// receiveStatus is our HTTP handler function for delivery reports
+func (h *handler) receiveStatus(ctx context.Context, c courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	if err := verifyCallback(c, r); err != nil {
+		return nil, courier.WriteAndLogForbidden(ctx, w, r, c, err)
+	}
+
+	payload := &statusPayload{}
+	err := handlers.DecodeAndValidateForm(payload, r)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, c, w, r, err)
+	}
+
+	// unknown statuses are ignored rather than rejected so Hormuud doesn't keep retrying them
+	msgStatus, found := statusMapping[payload.Status]
+	if !found {
+		logrus.WithField("channel_uuid", c.UUID()).WithField("message_id", payload.MessageID).WithField("status", payload.Status).Warn("ignoring unknown HM DLR status")
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, fmt.Sprintf("ignoring unknown status '%s'", payload.Status))
+	}
+
+	// Hormuud can send the same report more than once, which we acknowledge without applying it again
+	seen, err := h.markStatusSeen(c, payload)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", c.UUID()).Error("error checking for duplicate HM DLR")
+	} else if seen {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, c, w, r, fmt.Sprintf("ignoring duplicate status '%s' for message '%s'", payload.Status, payload.MessageID))
+	}
+
+	var status courier.MsgStatus
+
+	// if we sent our own id as a reference and it was echoed back, that identifies the message more reliably
+	if msgID, found := referencedMsgID(c, r); found {
+		status = h.Backend().NewMsgStatusForID(c, msgID, msgStatus)
+	} else {
+		// reports for later parts of multipart messages are recorded against the id of the first part
+		externalID := h.resolvePartID(c, payload.MessageID)
+		status = h.Backend().NewMsgStatusForExternalID(c, externalID, msgStatus)
+	}
+
+	events, err := handlers.WriteMsgStatusAndResponse(ctx, h, c, status, w, r)
+	if err != nil {
+		// we didn't apply this report so shouldn't ignore Hormuud retrying it
+		h.forgetStatusSeen(c, payload)
+	}
+	return events, err
+}
+
+// markStatusSeen records that we've received the passed in delivery report, returning whether we already had within
+// the status_dedupe_seconds of the channel. Channels with a window of zero or less don't dedupe reports.
+func (h *handler) markStatusSeen(c courier.Channel, payload *statusPayload) (bool, error) {
+	window := c.IntConfigForKey(configStatusDedupe, defaultStatusDedupe)
+	rp := h.Backend().RedisPool()
+	if window <= 0 || rp == nil {
+		return false, nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", h.statusSeenKey(c, payload), "1", "EX", window, "NX"))
+	if err == redis.ErrNil {
+		return true, nil
+	}
+	return false, err
+}
+
+// forgetStatusSeen forgets that we've received the passed in delivery report
+func (h *handler) forgetStatusSeen(c courier.Channel, payload *statusPayload) {
+	rp := h.Backend().RedisPool()
+	if rp == nil {
+		return
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	conn.Do("DEL", h.statusSeenKey(c, payload))
+}
+
+func (h *handler) statusSeenKey(c courier.Channel, payload *statusPayload) string {
+	return fmt.Sprintf("%s%s%s_%s_%s", h.RedisKeyPrefix(), statusSeenPrefix, c.UUID(), payload.MessageID, payload.Status)
+}
+
+// referencedMsgID returns the id of our message from the reference field of the passed in delivery report, if the
+// channel has a reference field and the report includes a valid id in it
+func referencedMsgID(c courier.Channel, r *http.Request) (courier.MsgID, bool) {
+	field := c.StringConfigForKey(configReferenceField, "")
+	if field == "" {
+		return courier.NilMsgID, false
+	}
+
+	id, err := strconv.ParseInt(r.Form.Get(field), 10, 64)
+	if err != nil || id <= 0 {
+		return courier.NilMsgID, false
+	}
+	return courier.NewMsgID(id), true
+}
+
+// message types we send in mType
+const (
+	mTypeDefault = -1
+	mTypeUnicode = 8
+)
+
+// the data coding schemes of the PDUs we send for channels in pdu_mode
+const (
+	dcsGSM7 = 0x00
+	dcsUCS2 = 0x08
+)
+
+type mtPayload struct {
+	Mobile   string `json:"mobile"`
+	Message  string `json:"message"`
+	SenderID string `json:"senderid"`
+	SType    int    `json:"sType,omitempty"`
+	MType    int    `json:"mType"`
+	EType    int    `json:"eType"`
+	UDH      string `json:"UDH"`
+	Priority int    `json:"priority,omitempty"`
+	Validity int    `json:"validity,omitempty"`
+	DCS      *int   `json:"dcs,omitempty"`
+
+	// RequestDLR asks Hormuud to send delivery reports for the message to our status route, which it otherwise only
+	// does for accounts set up to always send them. It is set to 1 for channels with request_delivery_reports set.
+	RequestDLR int `json:"request_dlr,omitempty"`
+}
+
+// the cache keys of the HTTP clients we last made the requests of each channel with, for those with their own
+var (
+	channelTLSClients      = make(map[courier.ChannelUUID]string)
+	channelTLSClientsMutex sync.Mutex
+)
+
+// the fields of the messages we send, which channels can rename with the field_names config, and those of them which
+// every message must have
+var (
+	mtPayloadFields         = []string{"mobile", "message", "senderid", "sType", "mType", "eType", "UDH", "priority", "validity", "dcs", "request_dlr"}
+	mtPayloadRequiredFields = []string{"mobile", "message", "senderid"}
+)
+
+// the values of the sType field of the messages we send, numeric sender ids are sent by omitting it
+const (
+	sTypeNumeric      = 0
+	sTypeAlphanumeric = 1
+)
+
+// the values of the priority field of the messages we send, normal priority is sent by omitting it
+const (
+	priorityNormal = 0
+	priorityHigh   = 1
+	priorityFlash  = 2
+)
+
+// the priorities messages and channels can ask for in their priority metadata or config
+var priorityMapping = map[string]int{
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+	"flash":  priorityFlash,
+}
+
+// mtResponse is the response to a send request
+type mtResponse struct {
+	ResCode responseCode `json:"ResCode"`
+	ResMsg  string       `json:"ResMsg"`
+	Data    struct {
+		MessageID   string         `json:"MessageID"`
+		Description string         `json:"Description"`
+		Balance     accountBalance `json:"Balance"`
+	} `json:"Data"`
+}
+
+// failed returns whether this response has a numeric code outside the 2xx range
+func (r *mtResponse) failed() bool {
+	code, err := strconv.Atoi(string(r.ResCode))
+	return err == nil && (code < 200 || code > 299)
+}
+
+// errorMessage returns the most specific description of the error in this response
+func (r *mtResponse) errorMessage() string {
+	if r.Data.Description != "" {
+		return r.Data.Description
+	}
+	return r.ResMsg
+}
+
+// responseCode is the code of a send response, which Hormuud sends as either a string or a number
+type responseCode string
+
+// UnmarshalJSON unmarshals a response code from either a JSON string or number
+func (c *responseCode) UnmarshalJSON(data []byte) error {
+	var code json.Number
+	if err := json.Unmarshal(data, &code); err == nil {
+		*c = responseCode(code)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*c = responseCode(str)
+	return nil
+}
+
+// accountBalance is the remaining credit of a Hormuud account, which some send responses include as either a string or
+// a number. Values we can't parse are ignored rather than failing the response.
+type accountBalance struct {
+	value float64
+	valid bool
+}
+
+// UnmarshalJSON unmarshals a balance from either a JSON string or number, leaving it invalid if it's neither
+func (b *accountBalance) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		var str string
+		json.Unmarshal(data, &str)
+		number = json.Number(strings.TrimSpace(str))
+	}
+
+	if value, err := number.Float64(); err == nil {
+		*b = accountBalance{value: value, valid: true}
+	}
+	return nil
+}
+
+// SendMsg sends the passed in message, returning any error
+func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+
+	// Hormuud silently drops messages to malformed numbers, so fail them ourselves rather than sending them
+	mobile, err := normalizeMobile(msg.Channel(), msg.URN().Path())
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonInvalidDestination)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Number", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// a template which can't be filled in won't be fixed by retrying either
+	templateText, isTemplate, err := templateTextForMsg(msg)
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonInvalidMessage)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Template", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// scheduled messages are passed on to Hormuud to send later, but only if we've been told how, sending them now would
+	// be worse than not sending them at all
+	sendAfter, err := sendAfterForMsg(msg, time.Now())
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonInvalidMessage)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Send After", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+	scheduleField := msg.Channel().StringConfigForKey(configScheduleField, "")
+	if !sendAfter.IsZero() && scheduleField == "" {
+		err = errors.Errorf("message is scheduled for %s but channel has no %s config to schedule it with", sendAfter.UTC().Format(time.RFC3339), configScheduleField)
+		status.SetReason(courier.MsgReasonUnsupported)
+		status.AddLog(courier.NewChannelLogFromError("Scheduling Unsupported", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// channels can restrict the hours they send in, messages outside them are left errored to be retried once they open
+	window, err := sendWindowForChannel(msg.Channel())
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonConfigError)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Send Window", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+	if window != nil && !isTransactional(msg) {
+		if untilOpen := window.untilOpen(time.Now()); untilOpen > 0 {
+			err = errors.Errorf("outside of send window %s, retry in %s", msg.Channel().StringConfigForKey(configSendWindow, ""), untilOpen)
+			status.SetReason(courier.MsgReasonOutsideSendWindow)
+			status.SetRetryAfter(untilOpen)
+			status.AddLog(courier.NewChannelLogFromError("Outside Send Window", msg.Channel(), msg.ID(), 0, err))
+			return status, nil
+		}
+	}
+
+	// gateways compatible with Hormuud's API can name its fields differently, but a message we can't name can't be sent
+	fieldNames, err := fieldNamesForChannel(msg.Channel())
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonConfigError)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Field Names", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// operators can guard against sending from sender ids they haven't approved, e.g. from a mistyped sender_ids entry
+	if senderID := senderIDForMobile(msg.Channel(), mobile); !senderIDAllowed(msg.Channel(), senderID) {
+		err = errors.Errorf("sender id '%s' is not in the channel's %s", senderID, configAllowedSenderIDs)
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonSenderNotAllowed)
+		status.AddLog(courier.NewChannelLogFromError("Sender Not Allowed", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// messages can have a validity period after which the SMSC drops them if they're still undelivered, e.g. so one time
+	// passwords don't arrive once they've expired
+	validity, err := validityForMsg(msg)
+	if err != nil {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonInvalidMessage)
+		status.AddLog(courier.NewChannelLogFromError("Invalid Validity", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// a client certificate which doesn't load or a proxy we can't parse won't work on a retry either
+	if _, err := httpClientForChannel(msg.Channel()); err != nil {
+		description := "Invalid TLS Config"
+		var configErr *ConfigError
+		if errors.As(err, &configErr) && configErr.Key == configHTTPProxy {
+			description = "Invalid Proxy Config"
+		}
+
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonConfigError)
+		status.AddLog(courier.NewChannelLogFromError(description, msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// SMS has no native quick replies so we send them as numbered options, templates are pre-approved so are sent as is
+	text := templateText
+	if !isTemplate {
+		text = handlers.TextWithQuickReplies(textForMsg(msg), msg.QuickReplies())
+	}
+
+	// channels whose contacts' handsets can't show Arabic script can have messages transliterated, which also keeps
+	// them to fewer GSM7 parts, but we'd rather send the original than something we had to guess parts of
+	if msg.Channel().BoolConfigForKey(configTransliterate, false) && !isGSM7(text) {
+		log := logrus.WithField("channel_uuid", msg.Channel().UUID()).WithField("msg_id", msg.ID())
+		if transliterated, ok := handlers.TransliterateGSM7(text); ok {
+			log.WithField("transliterated", transliterated).Info("transliterated HM message")
+			text = transliterated
+		} else {
+			log.Info("unable to transliterate HM message, sending original")
+		}
+	}
+
+	parts, language, mType := splitText(msg.Channel(), text, h.maxMsgLength())
+
+	// guard against runaway messages being billed as dozens of parts
+	maxParts := msg.Channel().IntConfigForKey(configMaxParts, 0)
+	if maxParts > 0 && len(parts) > maxParts {
+		log := logrus.WithField("channel_uuid", msg.Channel().UUID()).WithField("msg_id", msg.ID()).WithField("parts", len(parts)).WithField("max_parts", maxParts)
+
+		if msg.Channel().StringConfigForKey(configMaxPartsMode, maxPartsModeTruncate) == maxPartsModeFail {
+			log.Warn("failing HM message with too many parts")
+			err = errors.Errorf("message has %d parts which is more than the maximum of %d", len(parts), maxParts)
+			status.SetStatus(courier.MsgFailed)
+			status.SetReason(courier.MsgReasonInvalidMessage)
+			status.AddLog(courier.NewChannelLogFromError("Message Too Long", msg.Channel(), msg.ID(), 0, err))
+			return status, nil
+		}
+
+		log.Warn("truncating HM message with too many parts")
+		parts = parts[:maxParts]
+	}
+
+	// Hormuud throttles us if we send too fast, so leave messages over our configured rate errored to be retried later,
+	// each part is its own request so takes its own share of that rate
+	maxRate := msg.Channel().IntConfigForKey(configMaxRate, 0)
+	allowed, err := handlers.RateLimit(h.Backend().RedisPool(), msg.Channel(), h.RedisKeyPrefix(), maxRate, len(parts))
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error checking send rate")
+	} else if !allowed {
+		err = errors.Errorf("send rate of %d per second exceeded, retry later", maxRate)
+		status.SetReason(courier.MsgReasonThrottled)
+		status.AddLog(courier.NewChannelLogFromError("Message Throttled", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	// if Hormuud keeps failing our sends, leave messages errored to be retried later rather than adding to its load
+	breaker := h.breakerForChannel(msg.Channel())
+	state, allowed, err := breaker.Allow(h.Backend().RedisPool(), msg.Channel())
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error checking circuit breaker")
+	} else if !allowed {
+		err = errors.Errorf("circuit breaker is %s after repeated send failures, retry later", state)
+		status.SetReason(courier.MsgReasonProviderUnavailable)
+		status.AddLog(courier.NewChannelLogFromError("Circuit Breaker Open", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+
+	token, err := h.fetchTokenForStatus(ctx, msg, status)
+	if err != nil {
+		return nil, err
+	}
+
+	// failed getting a token? we are done
+	if token == "" {
+		return status, nil
+	}
+
+	// single part messages on channels with access to Hormuud's batch endpoint can be sent together with others
+	if len(parts) == 1 && sendAfter.IsZero() && batchSendForChannel(msg.Channel()) {
+		payload := &mtPayload{}
+		payload.Mobile = mobile
+		payload.Message = parts[0]
+		payload.SenderID = senderIDForMobile(msg.Channel(), payload.Mobile)
+		payload.SType = sTypeForSenderID(msg.Channel(), payload.SenderID)
+		payload.MType = mType
+		payload.EType = -1
+		payload.UDH = partUDH(int(msg.ID()), language, 1, 1)
+		payload.Priority = priorityForMsg(msg)
+		payload.Validity = validity
+		payload.RequestDLR = requestDLRForChannel(msg.Channel())
+
+		if batch := h.joinBatch(ctx, breaker, msg, status, token, payload); batch != nil {
+			select {
+			case <-batch.done:
+				return status, nil
+
+			// if our send times out before the batch is done, we leave it if it hasn't been sent yet, otherwise our
+			// status belongs to it so we report on a new one
+			case <-ctx.Done():
+				if !h.leaveBatch(batch, msg) {
+					status = h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+				}
+				status.SetReason(courier.MsgReasonConnectionError)
+				status.AddLog(courier.NewChannelLogFromError("Message Send Error", msg.Channel(), msg.ID(), 0, errors.Wrapf(ctx.Err(), "gave up waiting for batch")))
+				return status, nil
+			}
+		}
+	}
+
+	// one slow channel shouldn't tie up all our workers, so leave messages over its share errored to be retried later,
+	// batched messages are sent together by a single request so take one slot between them when it's made
+	release, allowed, err := h.inFlight.Acquire(concurrencyPoolForChannel(h.Backend().RedisPool(), msg.Channel()), msg.Channel(), msg.Channel().IntConfigForKey(configMaxConcurrency, 0))
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error checking sends in flight")
+	} else if !allowed {
+		err = errors.Errorf("channel already has %d sends in flight, retry later", msg.Channel().IntConfigForKey(configMaxConcurrency, 0))
+		status.SetReason(courier.MsgReasonThrottled)
+		status.AddLog(courier.NewChannelLogFromError("Concurrency Limit Reached", msg.Channel(), msg.ID(), 0, err))
+		return status, nil
+	}
+	defer release()
+
+	interPartDelay := interPartDelayForChannel(msg.Channel())
+
+	// a part failing doesn't stop us sending the rest, so we collect the failures to work out the message's status
+	var failures []partFailure
+
+	for i, part := range parts {
+		// channels can pause between parts so that Hormuud is more likely to deliver them in order
+		if i > 0 && interPartDelay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(interPartDelay):
+			}
+		}
+
+		// if we're being stopped, leave the message errored to be retried rather than carrying on with its parts
+		if ctx.Err() != nil {
+			status.SetStatus(courier.MsgErrored)
+			status.SetReason(courier.MsgReasonCancelled)
+			status.AddLog(courier.NewChannelLogFromError("Send Cancelled", msg.Channel(), msg.ID(), 0, ctx.Err()))
+			return status, nil
+		}
+
+		payload := &mtPayload{}
+		payload.Mobile = mobile
+		payload.Message = part
+		payload.SenderID = senderIDForMobile(msg.Channel(), payload.Mobile)
+		payload.SType = sTypeForSenderID(msg.Channel(), payload.SenderID)
+		payload.MType = mType
+		payload.EType = -1
+		payload.UDH = partUDH(int(msg.ID()), language, len(parts), i+1)
+		payload.Priority = priorityForMsg(msg)
+		payload.Validity = validity
+		payload.RequestDLR = requestDLRForChannel(msg.Channel())
+
+		// binary integrations of Hormuud's API take each part as the hex of its encoded user data rather than its text
+		if msg.Channel().BoolConfigForKey(configPDUMode, false) {
+			userData, dcs := encodePDU(part, mType, payload.UDH)
+			payload.Message = userData
+			payload.DCS = &dcs
+		}
+
+		requestBody := &bytes.Buffer{}
+		json.NewEncoder(requestBody).Encode(payload)
+		body := requestBody.Bytes()
+
+		if len(fieldNames) > 0 {
+			body, err = renameFields(body, fieldNames)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to rename payload fields")
+			}
+		}
+
+		// channels can have our id sent as a reference which Hormuud echoes back in delivery reports
+		if field := msg.Channel().StringConfigForKey(configReferenceField, ""); field != "" {
+			body, err = jsonparser.Set(body, []byte(strconv.Quote(msg.ID().String())), field)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to add reference to payload")
+			}
+		}
+
+		if !sendAfter.IsZero() {
+			body, err = jsonparser.Set(body, []byte(strconv.Quote(sendAfter.UTC().Format(time.RFC3339))), scheduleField)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to add schedule to payload")
+			}
+		}
+
+		// channels can have the campaign of messages sent as a client reference, so Hormuud's reporting can break down
+		// by campaign too
+		if field := msg.Channel().StringConfigForKey(configCampaignField, ""); field != "" && msg.Campaign() != "" {
+			body, err = jsonparser.Set(body, []byte(strconv.Quote(msg.Campaign())), field)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to add campaign to payload")
+			}
+		}
+
+		// channels can have a key which stays the same across retries sent with each part, so that Hormuud can drop the
+		// duplicates of parts we sent before failing to record that we had. This only dedupes as well as Hormuud does.
+		if field := msg.Channel().StringConfigForKey(configIdempotencyField, ""); field != "" {
+			body, err = jsonparser.Set(body, []byte(strconv.Quote(idempotencyKey(msg, i))), field)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to add idempotency key to payload")
+			}
+		}
+
+		rr, retried, err := h.sendPart(ctx, msg.Channel(), body, token)
+		if rr == nil {
+			return nil, err
+		}
+		for _, log := range retriedLogs(msg.Channel(), msg.ID(), retried) {
+			status.AddLog(log)
+		}
+		log := courier.NewChannelLogFromRR(sendLogDescription(msg.Channel()), msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+		status.AddLog(log)
+
+		// a 401 most likely means our cached token is stale, clear it and retry once with a fresh token
+		if rr.StatusCode == http.StatusUnauthorized {
+			h.clearToken(msg.Channel())
+
+			// if we can't get a fresh token this part has failed, but we carry on with the others, which may yet be
+			// accepted with the token we have
+			refreshed, tokenErr := h.fetchTokenForStatus(ctx, msg, status)
+			if tokenErr != nil {
+				status.AddLog(courier.NewChannelLogFromError("Token Retrieval Error", msg.Channel(), msg.ID(), 0, tokenErr))
+			}
+			if refreshed == "" {
+				outcome := courier.MsgErrored
+				if status.Status() == courier.MsgFailed {
+					outcome = courier.MsgFailed
+				}
+				status.SetReason(courier.MsgReasonTokenError)
+				failures = append(failures, partFailure{i + 1, outcome, courier.MsgReasonTokenError})
+				continue
+			}
+			token = refreshed
+
+			rr, retried, err = h.sendPart(ctx, msg.Channel(), body, token)
+			if rr == nil {
+				return nil, err
+			}
+			for _, log := range retriedLogs(msg.Channel(), msg.ID(), retried) {
+				status.AddLog(log)
+			}
+			log = courier.NewChannelLogFromRR(sendLogDescription(msg.Channel()), msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+			status.AddLog(log)
+		}
+
+		// channels with a secondary gateway retry the part against it once if the primary one is unavailable
+		if fallbackURL := msg.Channel().StringConfigForKey(configSendURLFallback, ""); fallbackURL != "" && shouldFailover(rr) {
+			rr, retried, err = h.sendPartTo(ctx, msg.Channel(), fallbackURL, body, token)
+			if rr == nil {
+				return nil, err
+			}
+			for _, log := range retriedLogs(msg.Channel(), msg.ID(), retried) {
+				status.AddLog(log)
+			}
+			log = courier.NewChannelLogFromRR("Message Sent (Fallback)", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+			status.AddLog(log)
+		}
+
+		h.recordSendResult(breaker, msg, status, rr)
+		setRetryAfter(status, rr)
+		setReasonForResponse(status, rr)
+
+		// client errors mean Hormuud won't ever accept this message, server errors and throttling might pass on a retry
+		if isPermanentFailure(rr) {
+			failures = append(failures, partFailure{i + 1, courier.MsgFailed, status.Reason()})
+			continue
+		}
+		if err != nil {
+			failures = append(failures, partFailure{i + 1, courier.MsgErrored, status.Reason()})
+			continue
+		}
+
+		// Hormuud can reject messages with a 200, so check the response for an error before assuming we succeeded
+		response := &mtResponse{}
+		err = json.Unmarshal(rr.Body, response)
+		if err != nil {
+			log.WithError("Message Send Error", errors.Wrapf(err, "unable to parse response"))
+			failures = append(failures, partFailure{i + 1, courier.MsgErrored, courier.MsgReasonProviderError})
+			continue
+		}
+
+		if response.failed() {
+			log.WithError("Message Send Error", errors.Errorf("received error code %s from Hormuud: %s", response.ResCode, response.errorMessage()))
+			failures = append(failures, partFailure{i + 1, courier.MsgFailed, courier.MsgReasonProviderError})
+			continue
+		}
+
+		// a success without a message id most likely means the response format has changed under us
+		id := response.Data.MessageID
+		if id == "" && !msg.Channel().BoolConfigForKey(configAllowMissingID, false) {
+			log.WithError("Message Send Error", errors.Errorf("no MessageID in response"))
+			failures = append(failures, partFailure{i + 1, courier.MsgErrored, courier.MsgReasonProviderError})
+			continue
+		}
+
+		if response.Data.Balance.valid {
+			h.recordBalance(msg, status, response.Data.Balance.value)
+		}
+
+		if id != "" {
+			// a message only has one external id, that of its first part we sent, so we remember which message the ids
+			// of any later parts belong to
+			if status.ExternalID() == "" {
+				status.SetExternalID(id)
+			} else {
+				h.recordPartID(msg.Channel(), id, status.ExternalID())
+			}
+		}
+	}
+
+	setStatusForParts(status, msg, len(parts), failures)
+	addBillingLog(status, msg, mobile, len(parts)-len(failures))
+	return status, nil
+}
+
+// billingRecord is what we record of each message we were billed for, for reconciling against Hormuud's invoices and
+// reporting on each campaign we send
+type billingRecord struct {
+	Destination string `json:"destination"`
+	Segments    int    `json:"segments"`
+	Campaign    string `json:"campaign,omitempty"`
+}
+
+// addBillingLog adds a log to the passed in status recording how many segments of the passed in message we sent to
+// the passed in mobile and so will be billed for. Nothing is logged if no segments were sent or we're on a dry run.
+func addBillingLog(status courier.MsgStatus, msg courier.Msg, mobile string, segments int) {
+	if segments <= 0 || msg.Channel().BoolConfigForKey(configDryRun, false) {
+		return
+	}
+
+	record, _ := json.Marshal(&billingRecord{Destination: mobile, Segments: segments, Campaign: msg.Campaign()})
+	status.AddLog(courier.NewChannelLog(billingLogDescription, msg.Channel(), msg.ID(), "", "", 0, "", string(record), 0, nil))
+}
+
+// partFailure is the outcome of a part of a message which we failed to send
+type partFailure struct {
+	sequence int
+	status   courier.MsgStatusValue
+	reason   courier.MsgStatusReason
+}
+
+// setStatusForParts sets the passed in status of a message of total parts from the passed in failures of its parts.
+// A message none of whose parts failed is wired, one all of whose parts failed takes the outcome of its last part,
+// and one with only some failed parts is left errored, as its contact has already been sent the others.
+func setStatusForParts(status courier.MsgStatus, msg courier.Msg, total int, failures []partFailure) {
+	switch {
+	case len(failures) == 0:
+		status.SetStatus(courier.MsgWired)
+		status.SetReason(courier.NilMsgStatusReason)
+
+	case len(failures) == total:
+		last := failures[len(failures)-1]
+		status.SetStatus(last.status)
+		status.SetReason(last.reason)
+
+	default:
+		sequences := make([]string, len(failures))
+		for i, failure := range failures {
+			sequences[i] = strconv.Itoa(failure.sequence)
+		}
+
+		err := errors.Errorf("%d of %d parts failed to send: %s", len(failures), total, strings.Join(sequences, ", "))
+		status.SetStatus(courier.MsgErrored)
+		status.SetReason(failures[0].reason)
+		status.AddLog(courier.NewChannelLogFromError("Partial Send", msg.Channel(), msg.ID(), 0, err))
+	}
+}
+
+// recordBalance reports the passed in account balance from a response to sending the passed in message, warning if
+// it has fallen to or below the low_balance_threshold of its channel since the last balance we saw
+func (h *handler) recordBalance(msg courier.Msg, status courier.MsgStatus, balance float64) {
+	channel := msg.Channel()
+	balanceGauge(fmt.Sprintf("courier.balance_%s_%s", channel.ChannelType(), channel.UUID()), balance)
+
+	threshold, hasThreshold := lowBalanceThresholdForChannel(channel)
+	rp := h.Backend().RedisPool()
+	if !hasThreshold || rp == nil {
+		return
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	// only warn as the balance crosses the threshold, not on every send after that
+	key := h.RedisKeyPrefix() + balancePrefix + channel.UUID().String()
+	previous, err := redis.Float64(conn.Do("GET", key))
+	crossed := balance <= threshold && (err == redis.ErrNil || (err == nil && previous > threshold))
+
+	_, err = conn.Do("SETEX", key, balanceTTL, strconv.FormatFloat(balance, 'f', -1, 64))
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error recording HM balance")
+	}
+
+	if crossed {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("event", lowBalanceEvent).WithField("balance", balance).WithField("threshold", threshold).Warn("HM balance is low")
+		err = errors.Errorf("account balance of %g is at or below threshold of %g", balance, threshold)
+		status.AddLog(courier.NewChannelLogFromError("Low Balance", channel, msg.ID(), 0, err))
+	}
+}
+
+// lowBalanceThresholdForChannel returns the balance at or below which we warn that the account of the passed in
+// channel is running low, and whether it configures one
+func lowBalanceThresholdForChannel(channel courier.Channel) (float64, bool) {
+	switch threshold := channel.ConfigForKey(configLowBalance, nil).(type) {
+	case float64:
+		return threshold, true
+	case int:
+		return float64(threshold), true
+	case string:
+		value, err := strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+		return value, err == nil
+	}
+	return 0, false
+}
+
+// sendAfterForMsg returns the time the passed in message shouldn't be sent before, from its metadata or else the
+// config of its channel, as an RFC3339 timestamp. A zero time is returned for messages which should be sent now,
+// including those scheduled for a time which has already passed.
+func sendAfterForMsg(msg courier.Msg, now time.Time) (time.Time, error) {
+	value := msg.Channel().StringConfigForKey(configSendAfter, "")
+	if len(msg.Metadata()) > 0 {
+		if metadataValue, err := jsonparser.GetString(msg.Metadata(), metadataSendAfter); err == nil {
+			value = metadataValue
+		}
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	sendAfter, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid send after '%s', must be an RFC3339 timestamp", value)
+	}
+	if !sendAfter.After(now) {
+		return time.Time{}, nil
+	}
+	return sendAfter, nil
+}
+
+// sendWindow is the time of day channels restrict their sends to, which can span midnight
+type sendWindow struct {
+	open     time.Duration
+	close    time.Duration
+	location *time.Location
+}
+
+// sendWindowForChannel returns the send window of the passed in channel, configured as a range of local times like
+// 08:00-20:00 in its send_window_timezone, or UTC if it doesn't have one. Nil is returned if it doesn't have a window.
+func sendWindowForChannel(channel courier.Channel) (*sendWindow, error) {
+	value := strings.TrimSpace(channel.StringConfigForKey(configSendWindow, ""))
+	if value == "" {
+		return nil, nil
+	}
+
+	times := strings.Split(value, "-")
+	if len(times) != 2 {
+		return nil, errors.Errorf("invalid send window '%s', must be a range like 08:00-20:00", value)
+	}
+
+	window := &sendWindow{}
+	for i, offset := range []*time.Duration{&window.open, &window.close} {
+		t, err := time.Parse("15:04", strings.TrimSpace(times[i]))
+		if err != nil {
+			return nil, errors.Errorf("invalid send window '%s', must be a range like 08:00-20:00", value)
+		}
+		*offset = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if window.open == window.close {
+		return nil, errors.Errorf("invalid send window '%s', must open and close at different times", value)
+	}
+
+	location, err := time.LoadLocation(channel.StringConfigForKey(configSendWindowTZ, "UTC"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid send window timezone")
+	}
+	window.location = location
+
+	return window, nil
+}
+
+// untilOpen returns how long after the passed in time the window next opens, which is zero if it's open then
+func (w *sendWindow) untilOpen(now time.Time) time.Duration {
+	local := now.In(w.location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+
+	if w.open < w.close && offset >= w.open && offset < w.close {
+		return 0
+	}
+
+	// windows which span midnight are open until they close the next day
+	if w.open > w.close && (offset >= w.open || offset < w.close) {
+		return 0
+	}
+
+	opens := time.Date(local.Year(), local.Month(), local.Day(), int(w.open/time.Hour), int(w.open%time.Hour/time.Minute), 0, 0, w.location)
+	if !opens.After(local) {
+		opens = time.Date(local.Year(), local.Month(), local.Day()+1, int(w.open/time.Hour), int(w.open%time.Hour/time.Minute), 0, 0, w.location)
+	}
+	return opens.Sub(now)
+}
+
+// isTransactional returns whether the passed in message is flagged in its metadata as transactional
+func isTransactional(msg courier.Msg) bool {
+	if len(msg.Metadata()) == 0 {
+		return false
+	}
+	transactional, _ := jsonparser.GetBoolean(msg.Metadata(), metadataTransactional)
+	return transactional
+}
+
+// normalizeMobile returns the passed in number as the international number, without a leading +, that Hormuud expects,
+// or an error if it isn't a plausible phone number. Numbers without a country code are treated as local to the channel.
+func normalizeMobile(channel courier.Channel, number string) (string, error) {
+	if !mobileCharsRegex.MatchString(number) {
+		return "", errors.Errorf("'%s' is not a valid phone number", number)
+	}
+
+	parsed, err := phonenumbers.Parse(number, channel.Country())
+	if err != nil || !phonenumbers.IsPossibleNumber(parsed) {
+		return "", errors.Errorf("'%s' is not a valid phone number", number)
+	}
+
+	return strings.TrimPrefix(phonenumbers.Format(parsed, phonenumbers.E164), "+"), nil
+}
+
+// priorityForMsg returns the priority we send the passed in message with. Messages and channels can ask for one using
+// a priority of normal, high or flash, where flash messages are class 0 SMS shown immediately and not stored by the
+// handset, or with flash set to true. What the message asks for takes precedence over its channel.
+func priorityForMsg(msg courier.Msg) int {
+	metadata := msg.Metadata()
+	if len(metadata) > 0 {
+		if flash, err := jsonparser.GetBoolean(metadata, configFlash); err == nil && flash {
+			return priorityFlash
+		}
+		if name, err := jsonparser.GetString(metadata, configPriority); err == nil {
+			if priority, found := priorityMapping[name]; found {
+				return priority
+			}
+		}
+	}
+
+	if msg.Channel().BoolConfigForKey(configFlash, false) {
+		return priorityFlash
+	}
+	if priority, found := priorityMapping[msg.Channel().StringConfigForKey(configPriority, "")]; found {
+		return priority
+	}
+	return priorityNormal
+}
+
+// requestDLRForChannel returns the value of the request_dlr field of the messages we send on the passed in channel,
+// 1 if it has request_delivery_reports set, otherwise 0 so the field is omitted. Requesting them has Hormuud call our
+// status route for each message part it delivers or fails to, which is a callback per part so it is off by default.
+// The reports only update our messages if the route can match them, so channels which request them should also have
+// the status route configured as their callback URL with Hormuud.
+func requestDLRForChannel(channel courier.Channel) int {
+	if channel.BoolConfigForKey(configRequestDLR, false) {
+		return 1
+	}
+	return 0
+}
+
+// validityForMsg returns how many minutes the SMSC should try to deliver the passed in message for, from its
+// validity_minutes metadata or else the config of its channel. Zero means Hormuud's default validity period.
+func validityForMsg(msg courier.Msg) (int, error) {
+	validity := msg.Channel().IntConfigForKey(configValidity, 0)
+	if len(msg.Metadata()) > 0 {
+		if value, err := jsonparser.GetInt(msg.Metadata(), configValidity); err == nil {
+			validity = int(value)
+		}
+	}
+
+	if validity < 0 || validity > maxValidity {
+		return 0, errors.Errorf("validity of %d minutes must be between 1 and %d, or 0 for Hormuud's default", validity, maxValidity)
+	}
+	return validity, nil
+}
+
+// breakerForChannel returns the circuit breaker for sends to the passed in channel
+func (h *handler) breakerForChannel(channel courier.Channel) *handlers.CircuitBreaker {
+	return &handlers.CircuitBreaker{
+		KeyPrefix: h.RedisKeyPrefix(),
+		Threshold: channel.IntConfigForKey(configBreakerThreshold, defaultBreakerThreshold),
+		Window:    time.Duration(channel.IntConfigForKey(configBreakerWindow, defaultBreakerWindow)) * time.Second,
+		Cooldown:  time.Duration(channel.IntConfigForKey(configBreakerCooldown, defaultBreakerCooldown)) * time.Second,
+	}
+}
+
+// recordSendResult updates the passed in circuit breaker with the result of a send, only connection failures and
+// server errors count against it since anything else means Hormuud is up, adding a log if that changes its state
+func (h *handler) recordSendResult(breaker *handlers.CircuitBreaker, msg courier.Msg, status courier.MsgStatus, rr *utils.RequestResponse) {
+	rp := h.Backend().RedisPool()
+
+	if rr.Status == utils.RRConnectionFailure || rr.StatusCode >= 500 {
+		opened, err := breaker.RecordFailure(rp, msg.Channel())
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error recording send failure")
+		} else if opened {
+			err = errors.Errorf("sends paused for %d seconds after repeated failures", int(breaker.Cooldown/time.Second))
+			status.AddLog(courier.NewChannelLogFromError("Circuit Breaker Opened", msg.Channel(), msg.ID(), 0, err))
+		}
+		return
+	}
+
+	closed, err := breaker.RecordSuccess(rp, msg.Channel())
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", msg.Channel().UUID()).Error("error recording send success")
+	} else if closed {
+		status.AddLog(courier.NewChannelLog("Circuit Breaker Closed", msg.Channel(), msg.ID(), "", "", 0, "", "", 0, nil))
+	}
+}
+
+// mtBatchPayload is what we post to Hormuud's batch endpoint, the same text sent to each of its mobiles
+type mtBatchPayload struct {
+	Mobiles  []string `json:"mobiles"`
+	Message  string   `json:"message"`
+	SenderID string   `json:"senderid"`
+	SType    int      `json:"sType,omitempty"`
+	MType    int      `json:"mType"`
+	EType    int      `json:"eType"`
+	UDH      string   `json:"UDH"`
+	Priority int      `json:"priority,omitempty"`
+	Validity int      `json:"validity,omitempty"`
+
+	// RequestDLR asks Hormuud to send delivery reports for every message in the batch, as on mtPayload
+	RequestDLR int `json:"request_dlr,omitempty"`
+}
+
+// mtBatchResponse is Hormuud's response to a batch send, with a result for each mobile it was sent to
+type mtBatchResponse struct {
+	ResCode responseCode    `json:"ResCode"`
+	ResMsg  string          `json:"ResMsg"`
+	Data    []mtBatchResult `json:"Data"`
+}
+
+// mtBatchResult is the result of a batch send for one of its mobiles
+type mtBatchResult struct {
+	Mobile      string `json:"Mobile"`
+	MessageID   string `json:"MessageID"`
+	Description string `json:"Description"`
+}
+
+// failed returns whether this response has a numeric code outside the 2xx range
+func (r *mtBatchResponse) failed() bool {
+	return (&mtResponse{ResCode: r.ResCode}).failed()
+}
+
+// sendBatch is a batch of messages with the same text which are sent to Hormuud in a single request. The request is
+// made with the context of the first message to join, so is bounded by its send timeout.
+type sendBatch struct {
+	ctx     context.Context
+	channel courier.Channel
+	breaker *handlers.CircuitBreaker
+	token   string
+	payload mtBatchPayload
+	entries []*batchEntry
+
+	// whether the batch is being sent, after which messages can no longer join or leave it
+	sending bool
+
+	once sync.Once
+	done chan struct{}
+}
+
+// batchEntry is a message waiting in a batch and the status we set once the batch is sent
+type batchEntry struct {
+	msg    courier.Msg
+	status courier.MsgStatus
+	mobile string
+}
+
+// batchSendForChannel returns whether the passed in channel sends messages using Hormuud's batch endpoint. Batches
+// can't carry a reference or idempotency key for each of their messages so channels with either field never do, and
+// neither do channels which rename our fields as their gateways might not have a batch endpoint.
+func batchSendForChannel(channel courier.Channel) bool {
+	return channel.BoolConfigForKey(configBatchSend, false) &&
+		channel.StringConfigForKey(configReferenceField, "") == "" &&
+		channel.StringConfigForKey(configIdempotencyField, "") == "" &&
+		channel.StringConfigForKey(configCampaignField, "") == "" &&
+		channel.ConfigForKey(configFieldNames, nil) == nil &&
+		!channel.BoolConfigForKey(configPDUMode, false)
+}
+
+// idempotencyKey returns the key we send with the part at the passed in index of the passed in message, which is the
+// same every time we try to send it
+func idempotencyKey(msg courier.Msg, index int) string {
+	return fmt.Sprintf("%d-%d", msg.ID(), index+1)
+}
+
+// joinBatch adds the passed in message to the batch of messages with the same payload, bar the mobile, waiting to be
+// sent, starting a new batch if there isn't one. The status of the message is set once the returned batch is done. If
+// the batch already has a message for the same mobile nil is returned and the message should be sent on its own.
+func (h *handler) joinBatch(ctx context.Context, breaker *handlers.CircuitBreaker, msg courier.Msg, status courier.MsgStatus, token string, payload *mtPayload) *sendBatch {
+	key := fmt.Sprintf("%s|%s|%d|%s|%d|%d|%s", msg.Channel().UUID(), payload.SenderID, payload.MType, payload.UDH, payload.Priority, payload.Validity, payload.Message)
+
+	h.batchesMutex.Lock()
+	defer h.batchesMutex.Unlock()
+
+	if h.batches == nil {
+		h.batches = make(map[string]*sendBatch)
+	}
+
+	batch := h.batches[key]
+	if batch == nil {
+		batch = &sendBatch{
+			ctx:     ctx,
+			channel: msg.Channel(),
+			breaker: breaker,
+			token:   token,
+			payload: mtBatchPayload{
+				Message:    payload.Message,
+				SenderID:   payload.SenderID,
+				SType:      payload.SType,
+				MType:      payload.MType,
+				EType:      payload.EType,
+				UDH:        payload.UDH,
+				Priority:   payload.Priority,
+				Validity:   payload.Validity,
+				RequestDLR: payload.RequestDLR,
+			},
+			done: make(chan struct{}),
+		}
+		h.batches[key] = batch
+		afterFunc(batchWait, func() { h.flushBatch(key, batch) })
+	}
+
+	for _, entry := range batch.entries {
+		if entry.mobile == payload.Mobile {
+			return nil
+		}
+	}
+
+	batch.entries = append(batch.entries, &batchEntry{msg: msg, status: status, mobile: payload.Mobile})
+	batch.payload.Mobiles = append(batch.payload.Mobiles, payload.Mobile)
+
+	// full batches are sent straight away rather than waiting for more messages
+	if len(batch.entries) >= msg.Channel().IntConfigForKey(configBatchSize, defaultBatchSize) {
+		delete(h.batches, key)
+		go h.flushBatch(key, batch)
+	}
+
+	return batch
+}
+
+// leaveBatch removes the passed in message from the passed in batch, returning false if it's too late as the batch is
+// already being sent
+func (h *handler) leaveBatch(batch *sendBatch, msg courier.Msg) bool {
+	h.batchesMutex.Lock()
+	defer h.batchesMutex.Unlock()
+
+	if batch.sending {
+		return false
+	}
+
+	for i, entry := range batch.entries {
+		if entry.msg == msg {
+			batch.entries = append(batch.entries[:i], batch.entries[i+1:]...)
+			batch.payload.Mobiles = append(batch.payload.Mobiles[:i], batch.payload.Mobiles[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// flushBatch sends the passed in batch if it hasn't been sent already, setting the status of each of its messages
+func (h *handler) flushBatch(key string, batch *sendBatch) {
+	h.batchesMutex.Lock()
+	if h.batches[key] == batch {
+		delete(h.batches, key)
+	}
+	batch.sending = true
+	h.batchesMutex.Unlock()
+
+	batch.once.Do(func() {
+		defer close(batch.done)
+		h.sendBatch(batch)
+	})
+}
+
+// sendBatch sends the passed in batch to Hormuud, setting the status of each of its messages from the response
+func (h *handler) sendBatch(batch *sendBatch) {
+	channel := batch.channel
+	ctx := batch.ctx
+
+	// every message may have left the batch while it waited
+	if len(batch.entries) == 0 {
+		return
+	}
+
+	// the batch is a single request so takes a single one of the channel's slots for sends in flight
+	maxConcurrency := channel.IntConfigForKey(configMaxConcurrency, 0)
+	release, allowed, err := h.inFlight.Acquire(concurrencyPoolForChannel(h.Backend().RedisPool(), channel), channel, maxConcurrency)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error checking sends in flight")
+	} else if !allowed {
+		err = errors.Errorf("channel already has %d sends in flight, retry later", maxConcurrency)
+		for _, entry := range batch.entries {
+			entry.status.SetReason(courier.MsgReasonThrottled)
+			entry.status.AddLog(courier.NewChannelLogFromError("Concurrency Limit Reached", channel, entry.msg.ID(), 0, err))
+		}
+		return
+	}
+	defer release()
+
+	body, err := json.Marshal(batch.payload)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error encoding HM batch")
+		return
+	}
+
+	dryRunResponse := func() []byte {
+		response := &mtBatchResponse{ResCode: "200", ResMsg: "DRY RUN"}
+		for _, mobile := range batch.payload.Mobiles {
+			response.Data = append(response.Data, mtBatchResult{Mobile: mobile, MessageID: dryRunID(), Description: "dry run, message not sent"})
+		}
+		body, _ := json.Marshal(response)
+		return body
+	}
+
+	rr, retried, err := h.sendRequest(ctx, channel, channel.StringConfigForKey(configBatchSendURL, batchSendURL), body, batch.token, dryRunResponse)
+	if rr == nil {
+		for _, entry := range batch.entries {
+			entry.status.SetReason(courier.MsgReasonConnectionError)
+			entry.status.AddLog(courier.NewChannelLogFromError("Message Send Error", channel, entry.msg.ID(), 0, err))
+		}
+		return
+	}
+
+	logs := make([]*courier.ChannelLog, len(batch.entries))
+	for i, entry := range batch.entries {
+		for _, log := range retriedLogs(channel, entry.msg.ID(), retried) {
+			entry.status.AddLog(log)
+		}
+		logs[i] = courier.NewChannelLogFromRR(sendLogDescription(channel), channel, entry.msg.ID(), rr).WithError("Message Send Error", err)
+		entry.status.AddLog(logs[i])
+	}
+
+	first := batch.entries[0]
+	h.recordSendResult(batch.breaker, first.msg, first.status, rr)
+	for _, entry := range batch.entries {
+		setRetryAfter(entry.status, rr)
+		setReasonForResponse(entry.status, rr)
+	}
+
+	// a stale token fails the whole batch, so clear it and leave our messages errored to be retried with a fresh one
+	if rr.StatusCode == http.StatusUnauthorized {
+		h.clearToken(channel)
+		return
+	}
+
+	setAll := func(status courier.MsgStatusValue, reason courier.MsgStatusReason, err error) {
+		for i, entry := range batch.entries {
+			entry.status.SetStatus(status)
+			entry.status.SetReason(reason)
+			if err != nil {
+				logs[i].WithError("Message Send Error", err)
+			}
+		}
+	}
+
+	// client errors mean Hormuud won't ever accept these messages, server errors and throttling might pass on a retry
+	if isPermanentFailure(rr) {
+		setAll(courier.MsgFailed, courier.MsgReasonProviderError, nil)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	response := &mtBatchResponse{}
+	err = json.Unmarshal(rr.Body, response)
+	if err != nil {
+		setAll(courier.MsgErrored, courier.MsgReasonProviderError, errors.Wrapf(err, "unable to parse response"))
+		return
+	}
+
+	if response.failed() {
+		setAll(courier.MsgFailed, courier.MsgReasonProviderError, errors.Errorf("received error code %s from Hormuud: %s", response.ResCode, response.ResMsg))
+		return
+	}
+
+	// each of our messages gets the result for its own mobile
+	for i, entry := range batch.entries {
+		found := false
+		for _, result := range response.Data {
+			if result.Mobile != entry.mobile {
+				continue
+			}
+			found = true
+
+			if result.MessageID != "" {
+				entry.status.SetStatus(courier.MsgWired)
+				entry.status.SetExternalID(result.MessageID)
+				addBillingLog(entry.status, entry.msg, entry.mobile, 1)
+			} else if channel.BoolConfigForKey(configAllowMissingID, false) {
+				entry.status.SetStatus(courier.MsgWired)
+				addBillingLog(entry.status, entry.msg, entry.mobile, 1)
+			} else {
+				entry.status.SetStatus(courier.MsgFailed)
+				entry.status.SetReason(courier.MsgReasonInvalidDestination)
+				logs[i].WithError("Message Send Error", errors.Errorf("no MessageID in response for %s: %s", entry.mobile, result.Description))
+			}
+			break
+		}
+
+		if !found {
+			entry.status.SetReason(courier.MsgReasonProviderError)
+			logs[i].WithError("Message Send Error", errors.Errorf("no result in response for %s", entry.mobile))
+		}
+	}
+}
+
+// setRetryAfter sets how long the passed in status should wait before being retried if Hormuud throttled us and told
+// us how long to back off for
+func setRetryAfter(status courier.MsgStatus, rr *utils.RequestResponse) {
+	if rr.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if retryAfter, ok := utils.ParseRetryAfter(rr.Header.Get("Retry-After"), time.Now()); ok {
+		status.SetRetryAfter(retryAfter)
+	}
+}
+
+// isPermanentFailure returns whether the passed in response to our send request means Hormuud will never accept what we
+// sent, which is any client error except throttling. Auth errors are down to our token or credentials rather than the
+// message itself so those are retried too.
+func isPermanentFailure(rr *utils.RequestResponse) bool {
+	switch rr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return rr.StatusCode/100 == 4
+}
+
+// setReasonForResponse sets why the passed in status errored or failed from the passed in response to our send
+// request, leaving it alone if the request succeeded
+func setReasonForResponse(status courier.MsgStatus, rr *utils.RequestResponse) {
+	switch {
+	case rr.Status == utils.RRConnectionFailure:
+		status.SetReason(courier.MsgReasonConnectionError)
+	case rr.StatusCode == http.StatusUnauthorized || rr.StatusCode == http.StatusForbidden:
+		status.SetReason(courier.MsgReasonTokenError)
+	case rr.StatusCode == http.StatusTooManyRequests:
+		status.SetReason(courier.MsgReasonThrottled)
+	case rr.StatusCode/100 != 2:
+		status.SetReason(courier.MsgReasonProviderError)
+	}
+}
+
+// recordPartID maps the passed in message id of a later part of a multipart message to the id of its first part
+func (h *handler) recordPartID(channel courier.Channel, partID string, externalID string) {
+	rp := h.Backend().RedisPool()
+	if rp == nil {
+		return
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", h.partIDCacheKey(channel, partID), partIDTTL, externalID)
+	if err != nil {
+		logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error recording message part id")
+	}
+}
+
+// resolvePartID returns the id of the first part of the multipart message the passed in message id belongs to, or the
+// passed in id itself if it isn't a later part of one
+func (h *handler) resolvePartID(channel courier.Channel, partID string) string {
+	rp := h.Backend().RedisPool()
+	if rp == nil {
+		return partID
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	externalID, _ := redis.String(conn.Do("GET", h.partIDCacheKey(channel, partID)))
+	if externalID != "" {
+		return externalID
+	}
+	return partID
+}
+
+func (h *handler) partIDCacheKey(channel courier.Channel, partID string) string {
+	return fmt.Sprintf("%s%s%s_%s", h.RedisKeyPrefix(), partIDCachePrefix, channel.UUID(), partID)
+}
+
+// textForMsg returns the text we send for the passed in message, including its attachments according to the
+// attachment_mode of its channel. Hormuud is SMS only so attachments can only ever be sent as links.
+func textForMsg(msg courier.Msg) string {
+	if len(msg.Attachments()) == 0 {
+		return msg.Text()
+	}
+
+	mode := msg.Channel().StringConfigForKey(configAttachmentMode, attachmentModeInline)
+	switch mode {
+	case attachmentModeDrop:
+		// if there is no text, tell the contact they missed something rather than sending nothing
+		if strings.TrimSpace(msg.Text()) == "" {
+			return attachmentFooter
+		}
+		return msg.Text()
+
+	case attachmentModeFooter:
+		if strings.TrimSpace(msg.Text()) == "" {
+			return attachmentFooter
+		}
+		return msg.Text() + "\n" + attachmentFooter
+
+	case attachmentModeInline:
+		return handlers.GetTextAndAttachments(msg)
+
+	default:
+		logrus.WithField("channel_uuid", msg.Channel().UUID()).WithField("attachment_mode", mode).Warn("invalid attachment_mode for HM channel, using inline")
+		return handlers.GetTextAndAttachments(msg)
+	}
+}
+
+// templateTextForMsg returns the text of the channel's template filled in with the template params of the passed in
+// message, and whether the message should be sent using the template, which is only when both are present
+func templateTextForMsg(msg courier.Msg) (string, bool, error) {
+	template := msg.Channel().StringConfigForKey(configTemplate, "")
+	if template == "" || len(msg.Metadata()) == 0 {
+		return "", false, nil
+	}
+
+	paramsJSON, dataType, _, err := jsonparser.Get(msg.Metadata(), metadataTemplateParams)
+	if err != nil || dataType == jsonparser.Null {
+		return "", false, nil
+	}
+
+	params := make([]string, 0)
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return "", true, errors.Wrapf(err, "invalid %s in message metadata", metadataTemplateParams)
+	}
+
+	text, err := handlers.ApplyTemplate(template, params)
+	return text, true, err
+}
+
+// isGSM7 returns whether the passed in text can be encoded entirely using the GSM 03.38 alphabet
+func isGSM7(text string) bool {
+	return gsm7.IsValid(text)
+}
+
+// maxLengthForChannel returns the max length of each message part for the passed in channel, falling back to the
+// passed in default if the channel doesn't configure one or its configured value is out of range
+func maxLengthForChannel(channel courier.Channel, defaultLength int) int {
+	maxLength := channel.IntConfigForKey(courier.ConfigMaxLength, defaultLength)
+	if maxLength < 1 || maxLength > maxConfigMsgLength {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("max_length", maxLength).Warn("invalid max_length for HM channel, using default")
+		return defaultLength
+	}
+	return maxLength
+}
+
+// senderIDForMobile returns the sender id to send to the passed in mobile number from, which is the configured sender
+// id with the longest prefix matching the number, or the channel address if none match
+func senderIDForMobile(channel courier.Channel, mobile string) string {
+	senderID := channel.Address()
+	matchedLength := 0
+
+	for prefix, id := range senderIDsForChannel(channel) {
+		prefix = strings.TrimPrefix(prefix, "+")
+		if len(prefix) > matchedLength && strings.HasPrefix(mobile, prefix) {
+			senderID = id
+			matchedLength = len(prefix)
+		}
+	}
+	return senderID
+}
+
+// senderIDAllowed returns whether we can send from the passed in sender id, which is any sender id for channels without
+// an allowed_sender_ids config
+func senderIDAllowed(channel courier.Channel, senderID string) bool {
+	allowed := listForChannel(channel, configAllowedSenderIDs)
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, id := range allowed {
+		if id == senderID {
+			return true
+		}
+	}
+	return false
+}
+
+// sTypeForSenderID returns the sType we send messages from the passed in sender id with, which is the channel's
+// sender_type if it configures one, otherwise numeric for sender ids made up of only digits and alphanumeric for any
+// others, which Hormuud rejects if sent as numeric
+func sTypeForSenderID(channel courier.Channel, senderID string) int {
+	switch channel.StringConfigForKey(configSenderType, senderTypeAuto) {
+	case senderTypeNumeric:
+		return sTypeNumeric
+	case senderTypeAlphanumeric:
+		return sTypeAlphanumeric
+	}
+
+	senderID = strings.TrimPrefix(senderID, "+")
+	if senderID != "" && !nonDigitsRegex.MatchString(senderID) {
+		return sTypeNumeric
+	}
+	return sTypeAlphanumeric
+}
+
+// fieldNamesForChannel returns the map of our field names to those we send messages with for the passed in channel,
+// which may be configured either as an object or a string of JSON. Fields it doesn't rename keep their names and fields
+// it gives no name are left out, but an error is returned if it renames fields we don't have, leaves out a required
+// field or gives two fields the same name.
+func fieldNamesForChannel(channel courier.Channel) (map[string]string, error) {
+	fieldNames := make(map[string]string)
+
+	switch config := channel.ConfigForKey(configFieldNames, nil).(type) {
+	case nil:
+		return fieldNames, nil
+	case map[string]string:
+		fieldNames = config
+	case map[string]interface{}:
+		for field, name := range config {
+			nameStr, isStr := name.(string)
+			if !isStr {
+				return nil, errors.Errorf("name of field '%s' must be a string", field)
+			}
+			fieldNames[field] = nameStr
+		}
+	case string:
+		if err := json.Unmarshal([]byte(config), &fieldNames); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s config", configFieldNames)
+		}
+	default:
+		return nil, errors.Errorf("invalid %s config", configFieldNames)
+	}
+
+	for field := range fieldNames {
+		if !utils.StringArrayContains(mtPayloadFields, field) {
+			return nil, errors.Errorf("unknown field '%s'", field)
+		}
+	}
+
+	seen := make(map[string]string, len(mtPayloadFields))
+	for _, field := range mtPayloadFields {
+		name, renamed := fieldNames[field]
+		if !renamed {
+			name = field
+		}
+		name = strings.TrimSpace(name)
+		fieldNames[field] = name
+
+		// fields which aren't required can be left out by giving them no name
+		if name == "" {
+			if utils.StringArrayContains(mtPayloadRequiredFields, field) {
+				return nil, errors.Errorf("required field '%s' must have a name", field)
+			}
+			continue
+		}
+		if other, taken := seen[name]; taken {
+			return nil, errors.Errorf("fields '%s' and '%s' can't both be named '%s'", other, field, name)
+		}
+		seen[name] = field
+	}
+
+	return fieldNames, nil
+}
+
+// renameFields returns the passed in JSON object with its fields renamed as described by the passed in map, keeping
+// them in the same order and leaving out those renamed to nothing
+func renameFields(body []byte, names map[string]string) ([]byte, error) {
+	renamed := &bytes.Buffer{}
+	renamed.WriteByte('{')
+
+	err := jsonparser.ObjectEach(body, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		name, found := names[string(key)]
+		if !found {
+			name = string(key)
+		}
+		if name == "" {
+			return nil
+		}
+
+		if renamed.Len() > 1 {
+			renamed.WriteByte(',')
+		}
+		nameJSON, _ := json.Marshal(name)
+		renamed.Write(nameJSON)
+		renamed.WriteByte(':')
+
+		// string values are given to us without their quotes, but still escaped
+		if dataType == jsonparser.String {
+			renamed.WriteByte('"')
+			renamed.Write(value)
+			renamed.WriteByte('"')
+		} else {
+			renamed.Write(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	renamed.WriteString("}\n")
+	return renamed.Bytes(), nil
+}
+
+// senderIDsForChannel returns the map of number prefixes to sender ids configured for the passed in channel, which
+// may be configured either as an object or a string of JSON
+func senderIDsForChannel(channel courier.Channel) map[string]string {
+	senderIDs := make(map[string]string)
+
+	switch config := channel.ConfigForKey(configSenderIDs, nil).(type) {
+	case map[string]string:
+		senderIDs = config
+	case map[string]interface{}:
+		for prefix, id := range config {
+			if idStr, isStr := id.(string); isStr && idStr != "" {
+				senderIDs[prefix] = idStr
+			}
+		}
+	case string:
+		if err := json.Unmarshal([]byte(config), &senderIDs); err != nil {
+			logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Warn("invalid sender_ids for HM channel, ignoring")
+		}
+	}
+
+	return senderIDs
+}
+
+// splitText splits the passed in text into the parts we send it as, returning them along with the national language
+// whose shift tables they are encoded with and the message type to send them as. Parts are no longer than the max
+// length of the channel, or the passed in default if it doesn't configure one.
+func splitText(channel courier.Channel, text string, defaultLength int) ([]string, handlers.GSM7Language, int) {
+	maxLength := maxLengthForChannel(channel, defaultLength)
+	encoding := encodingForChannel(channel)
+
+	if encoding != encodingUCS2 {
+		if isGSM7(text) {
+			return splitGSM7(text, maxLength), handlers.GSM7Default, mTypeDefault
+		}
+
+		// text outside the default alphabet may still be GSM7 if the channel's language has shift tables for it
+		if parts, language, ok := splitTextForLanguage(channel, text, maxLength); ok {
+			return parts, language, mTypeDefault
+		}
+
+		// channels can force GSM7 for anything else, in which case Hormuud replaces what it can't encode
+		if encoding == encodingGSM7 {
+			return splitGSM7(text, maxLength), handlers.GSM7Default, mTypeDefault
+		}
+	}
+
+	// otherwise it has to be sent as UCS-2 which fits fewer characters per part, measured in UTF-16 code units as
+	// characters outside the basic multilingual plane, like most emoji, take two
+	if maxLength > maxUnicodeMsgLength {
+		maxLength = maxUnicodeMsgLength
+	}
+
+	parts := handlers.SplitMsgUCS2(text, maxLength)
+	if len(parts) > 1 && maxLength > unicodeConcatHeaderLength {
+		parts = handlers.SplitMsgUCS2(text, maxLength-unicodeConcatHeaderLength)
+	}
+	return parts, handlers.GSM7Default, mTypeUnicode
+}
+
+// splitGSM7 splits the passed in text into parts of at most maxLength characters of the default GSM7 alphabet
+func splitGSM7(text string, maxLength int) []string {
+	parts := handlers.SplitMsg(text, maxLength)
+
+	// messages spanning multiple segments need room for a concatenation header in each part
+	if len(parts) > 1 && maxLength > concatHeaderLength {
+		parts = handlers.SplitMsg(text, maxLength-concatHeaderLength)
+	}
+	return parts
+}
+
+// splitTextForLanguage splits the passed in text using the shift tables of the channel's language, returning false if
+// it doesn't have one or the text can't be encoded with it. Every part needs a header saying which tables it uses.
+func splitTextForLanguage(channel courier.Channel, text string, maxLength int) ([]string, handlers.GSM7Language, bool) {
+	language := gsm7LanguageForChannel(channel)
+	if _, valid := handlers.GSM7Septets(text, language); !valid || language == handlers.GSM7Default {
+		return nil, handlers.GSM7Default, false
+	}
+
+	headerLength := udhSeptets(partUDH(0, language, 1, 1))
+	parts := handlers.SplitMsgForLanguage(text, maxLength-headerLength, language)
+
+	if len(parts) > 1 {
+		headerLength = udhSeptets(partUDH(0, language, 2, 1))
+		parts = handlers.SplitMsgForLanguage(text, maxLength-headerLength, language)
+	}
+	return parts, language, true
+}
+
+// encodingForChannel returns how the passed in channel wants its messages encoded
+func encodingForChannel(channel courier.Channel) string {
+	encoding := channel.StringConfigForKey(configForceEncoding, encodingAuto)
+	if encoding != encodingAuto && encoding != encodingGSM7 && encoding != encodingUCS2 {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("force_encoding", encoding).Warn("invalid force_encoding for HM channel, using auto")
+		return encodingAuto
+	}
+	return encoding
+}
+
+// gsm7LanguageForChannel returns the national language whose shift tables we can encode messages for the passed in
+// channel with, which is always the default alphabet for channels in pdu_mode as we only encode PDUs with that
+func gsm7LanguageForChannel(channel courier.Channel) handlers.GSM7Language {
+	if channel.BoolConfigForKey(configPDUMode, false) {
+		return handlers.GSM7Default
+	}
+
+	language := handlers.GSM7Language(channel.StringConfigForKey(configGSM7Language, ""))
+	if !language.IsValid() {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("gsm7_language", language).Warn("invalid gsm7_language for HM channel, ignoring")
+		return handlers.GSM7Default
+	}
+	return language
+}
+
+// partUDH builds the hex encoded user data header for the sequence'th part of a message of total parts encoded with
+// the shift tables of the passed in language, returning an empty string if the part doesn't need one
+func partUDH(ref int, language handlers.GSM7Language, total int, sequence int) string {
+	elements := ""
+	if total > 1 {
+		elements += fmt.Sprintf("0003%02X%02X%02X", ref%256, total, sequence)
+	}
+	if language != handlers.GSM7Default {
+		if language.HasLockingShift() {
+			elements += fmt.Sprintf("2401%02X", language.ShiftTableID())
+		}
+		elements += fmt.Sprintf("2501%02X", language.ShiftTableID())
+	}
+	if elements == "" {
+		return ""
+	}
+
+	// headers start with the number of bytes in them
+	return fmt.Sprintf("%02X%s", len(elements)/2, elements)
+}
+
+// concatUDH builds the hex encoded user data header for the sequence'th part of a concatenated message of total parts
+func concatUDH(ref int, total int, sequence int) string {
+	return partUDH(ref, handlers.GSM7Default, total, sequence)
+}
+
+// encodePDU encodes the passed in part of a message of the passed in message type into the hex of the user data of its
+// PDU, which starts with the passed in hex encoded user data header if there is one, returning it along with the data
+// coding scheme it is encoded with
+func encodePDU(part string, mType int, udh string) (string, int) {
+	header, _ := hex.DecodeString(udh)
+
+	if mType == mTypeUnicode {
+		userData := header
+		for _, unit := range utf16.Encode([]rune(part)) {
+			userData = append(userData, byte(unit>>8), byte(unit))
+		}
+		return strings.ToUpper(hex.EncodeToString(userData)), dcsUCS2
+	}
+
+	// septets are packed from the first septet boundary after our header
+	fillBits := (7 - len(header)*8%7) % 7
+	userData := append(header, packSeptets(gsm7.Encode(part), fillBits)...)
+	return strings.ToUpper(hex.EncodeToString(userData)), dcsGSM7
+}
+
+// packSeptets packs the passed in GSM7 septets into octets, least significant bit first, after the passed in number of
+// zero fill bits
+func packSeptets(septets []byte, fillBits int) []byte {
+	packed := make([]byte, (fillBits+len(septets)*7+7)/8)
+	for i, septet := range septets {
+		bit := fillBits + i*7
+		packed[bit/8] |= septet << (bit % 8)
+		if bit%8 > 1 {
+			packed[bit/8+1] |= septet >> (8 - bit%8)
+		}
+	}
+	return packed
+}
+
+// udhSeptets returns how many septets the passed in hex encoded user data header takes away from a GSM7 message part
+func udhSeptets(udh string) int {
+	return (len(udh)/2*8 + 6) / 7
+}
+
+// fetchTokenForStatus fetches the token for the channel of the passed in message, adding a log to the status if a token
+// request was made. An empty token is returned if the token request failed.
+func (h *handler) fetchTokenForStatus(ctx context.Context, msg courier.Msg, status courier.MsgStatus) (string, error) {
+	token, rr, err := h.FetchToken(ctx, msg.Channel(), msg)
+
+	// misconfigured channels will never succeed, so fail rather than retrying
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		status.SetStatus(courier.MsgFailed)
+		status.SetReason(courier.MsgReasonTokenError)
+		if rr != nil {
+			status.AddLog(courier.NewChannelLogFromRR(tokenRetrievedDescription, msg.Channel(), msg.ID(), rr).WithError("Token Retrieval Error", err))
+		} else {
+			status.AddLog(courier.NewChannelLogFromError("Token Retrieval Error", msg.Channel(), msg.ID(), 0, err))
+		}
+		return "", nil
+	}
+
+	if rr == nil && err != nil {
+		return "", errors.Wrapf(err, "unable to fetch token")
+	}
+
+	// if we made a request for our token, stash that in our status, otherwise note that we used a cached one
+	if rr != nil {
+		log := courier.NewChannelLogFromRR(tokenRetrievedDescription, msg.Channel(), msg.ID(), rr).WithError("Token Retrieval Error", err)
+		status.AddLog(log)
+	} else if err == nil {
+		status.AddLog(courier.NewChannelLog("Using cached token", msg.Channel(), msg.ID(), "", "", 0, "", "", 0, nil))
+	}
+
+	if err != nil {
+		status.SetReason(courier.MsgReasonTokenError)
+		return "", nil
+	}
+
+	return token, nil
+}
+
+// sendPart posts the passed in JSON payload to the channel's send URL using the passed in token
+func (h *handler) sendPart(ctx context.Context, channel courier.Channel, body []byte, token string) (*utils.RequestResponse, []*utils.RequestResponse, error) {
+	return h.sendPartTo(ctx, channel, channel.StringConfigForKey(courier.ConfigSendURL, sendURL), body, token)
+}
+
+// sendPartTo posts the passed in JSON payload to the passed in send URL using the passed in token
+func (h *handler) sendPartTo(ctx context.Context, channel courier.Channel, url string, body []byte, token string) (*utils.RequestResponse, []*utils.RequestResponse, error) {
+	dryRunResponse := func() []byte {
+		return []byte(fmt.Sprintf(`{"ResCode": "200", "ResMsg": "DRY RUN", "Data": {"MessageID": "%s", "Description": "dry run, message not sent"}}`, dryRunID()))
+	}
+	return h.sendRequest(ctx, channel, url, body, token, dryRunResponse)
+}
+
+// shouldFailover returns whether the passed in response to a send means the gateway we sent it to is unavailable, so
+// that it's worth trying another
+func shouldFailover(rr *utils.RequestResponse) bool {
+	return rr.Status == utils.RRConnectionFailure || rr.StatusCode >= 500
+}
+
+// sendRequest posts the passed in body to the passed in Hormuud URL using the passed in token. In dry runs the request
+// isn't made, instead we trace it and pretend Hormuud responded with the passed in response. Along with the response
+// to the request we return those of any earlier attempts at it which failed and were retried.
+func (h *handler) sendRequest(ctx context.Context, channel courier.Channel, url string, body []byte, token string, dryRunResponse func() []byte) (*utils.RequestResponse, []*utils.RequestResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	// our token isn't always sent in a header we'd redact anyway, so make sure it is in the traces of this request
+	authHeader := channel.StringConfigForKey(configAuthHeader, defaultAuthHeader)
+	req.Header.Set(authHeader, channel.StringConfigForKey(configAuthScheme, defaultAuthScheme)+token)
+	ctx = utils.WithRedactedHeaders(ctx, authHeader)
+	req = req.WithContext(ctx)
+	setUserAgent(req, channel)
+
+	// in dry runs we trace the request we would have made and pretend Hormuud accepted it
+	if channel.BoolConfigForKey(configDryRun, false) {
+		rr, err := utils.MakeDryRunHTTPRequest(req, "application/json", dryRunResponse())
+		return rr, nil, err
+	}
+
+	client, err := httpClientForChannel(channel)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := sendRetryOptions(channel)
+	opts.Client = client
+
+	start := time.Now()
+	rr, attempts, err := utils.MakeHTTPRequestWithRetry(req.WithContext(ctx), opts)
+	sendTimingGauge(fmt.Sprintf("courier.send_request_%s", channel.ChannelType()), float64(time.Since(start))/float64(time.Second))
+
+	return rr, attempts[:len(attempts)-1], err
+}
+
+// concurrencyPoolForChannel returns the redis pool we count the sends in flight for the passed in channel in, which is
+// nil for channels which count them locally
+func concurrencyPoolForChannel(rp *redis.Pool, channel courier.Channel) *redis.Pool {
+	if channel.StringConfigForKey(configConcurrencyMode, concurrencyModeLocal) == concurrencyModeRedis {
+		return rp
+	}
+	return nil
+}
+
+// interPartDelayForChannel returns how long we wait between sending the parts of multipart messages for the passed in
+// channel, which is zero unless it configures a valid inter_part_delay_ms
+func interPartDelayForChannel(channel courier.Channel) time.Duration {
+	delay := channel.IntConfigForKey(configInterPartDelay, 0)
+	if delay < 0 || delay > maxInterPartDelay {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("inter_part_delay_ms", delay).Warn("invalid inter_part_delay_ms for HM channel, ignoring")
+		return 0
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// sendRetryOptions returns how we retry transient failures of the send requests of the passed in channel, which are
+// only retried if it configures send_retries. Each attempt is given the channel's http_timeout_seconds.
+func sendRetryOptions(channel courier.Channel) utils.RetryOptions {
+	retries := channel.IntConfigForKey(configSendRetries, 0)
+	if retries < 0 || retries > maxSendRetries {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("send_retries", retries).Warn("invalid send_retries for HM channel, ignoring")
+		retries = 0
+	}
+
+	return utils.RetryOptions{
+		MaxAttempts:          retries + 1,
+		BaseDelay:            time.Duration(channel.IntConfigForKey(configSendRetryDelay, defaultSendRetryDelay)) * time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		AttemptTimeout:       httpTimeoutForChannel(channel),
+	}
+}
+
+// retriedLogs returns the logs of the passed in attempts at sending the passed in message which failed and were retried
+func retriedLogs(channel courier.Channel, msgID courier.MsgID, retried []*utils.RequestResponse) []*courier.ChannelLog {
+	logs := make([]*courier.ChannelLog, len(retried))
+	for i, rr := range retried {
+		logs[i] = courier.NewChannelLogFromRR(sendLogDescription(channel), channel, msgID, rr).WithError("Message Send Error", attemptError(rr))
+	}
+	return logs
+}
+
+// attemptError returns the error of the passed in failed attempt at a request
+func attemptError(rr *utils.RequestResponse) error {
+	if rr.Status == utils.RRConnectionFailure {
+		return errors.New(string(rr.Body))
+	}
+	return errors.Errorf("received non 200 status: %d", rr.StatusCode)
+}
+
+// dryRunID returns a new synthetic message id for a message sent in a dry run
+func dryRunID() string {
+	u, _ := uuid.NewV4()
+	return dryRunIDPrefix + u.String()
+}
+
+// sendLogDescription returns the description of the channel logs of our send requests for the passed in channel
+func sendLogDescription(channel courier.Channel) string {
+	if channel.BoolConfigForKey(configDryRun, false) {
+		return "Message Sent (Dry Run)"
+	}
+	return "Message Sent"
+}
+
+// withHTTPTimeout returns a context for requests made for the passed in channel which is cancelled after its configured
+// http_timeout_seconds, no timeout is added if it doesn't have one
+func withHTTPTimeout(ctx context.Context, channel courier.Channel) (context.Context, context.CancelFunc) {
+	timeout := httpTimeoutForChannel(channel)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// httpTimeoutForChannel returns the configured timeout for requests made for the passed in channel, or zero if it
+// doesn't have a valid one
+func httpTimeoutForChannel(channel courier.Channel) time.Duration {
+	seconds := channel.IntConfigForKey(configHTTPTimeout, 0)
+	if seconds == 0 {
+		return 0
+	}
+	if seconds < 1 || seconds > maxHTTPTimeout {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("http_timeout_seconds", seconds).Warn("invalid http_timeout_seconds for HM channel, ignoring")
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token" validate:"required"`
+}
+
+// WarmToken makes sure a token for the passed in channel is cached, fetching one if it isn't, so that sends don't have
+// to wait for one
+func (h *handler) WarmToken(ctx context.Context, channel courier.Channel) error {
+	// there's nothing to warm for channels which don't cache their tokens
+	if !channel.BoolConfigForKey(configCacheToken, true) {
+		return nil
+	}
+
+	_, _, err := h.FetchToken(ctx, channel, nil)
+	return err
+}
+
+// FetchToken gets the current token for this channel, either from Redis if cached or by requesting it. The message the
+// token is for is optional and may be nil, e.g. when warming the cache. Channels with cache_token set to false always
+// request a new token which is never written to Redis.
+func (h *handler) FetchToken(ctx context.Context, channel courier.Channel, msg courier.Msg) (string, *utils.RequestResponse, error) {
+	var rr *utils.RequestResponse
+	rp := h.Backend().RedisPool()
+	fetch := func() (string, int, error) {
+		var token string
+		var err error
+
+		// if our recent token requests failed, fail fast rather than hammering Hormuud while it recovers
+		if h.inTokenBackoff(rp, channel) {
+			return "", 0, &TransientError{errors.Errorf("backing off HM token requests after recent failures")}
+		}
+
+		token, rr, err = h.requestOrRefreshToken(ctx, channel)
+		if err != nil {
+			log := tokenLog(channel).WithError(err)
+			if rr != nil {
+				log = log.WithField("status_code", rr.StatusCode)
+			}
+			log.Error("error fetching HM access token")
+
+			var transientErr *TransientError
+			if errors.As(err, &transientErr) {
+				h.recordTokenFailure(rp, channel)
+			}
+			return "", 0, err
+		}
+
+		h.clearTokenBackoff(rp, channel)
+		h.cacheRefreshToken(channel, rr.Body)
+
+		// expire our cached token a little before Hormuud does so we refresh proactively
+		ttl := jitterTTL(tokenTTL(channel, rr.Body))
+
+		// refreshes more frequent than our TTLs would suggest point at clock skew or misconfigured TTLs, so we tag each
+		// one for monitoring, logs of refreshes for messages are added to their statuses by fetchTokenForStatus
+		tokenLog(channel).WithField("event", tokenRefreshedEvent).WithField("elapsed", rr.Elapsed).WithField("ttl", ttl).WithField("expires_on", time.Now().Add(time.Duration(ttl)*time.Second)).Info("refreshed HM access token")
+		if msg == nil {
+			h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{courier.NewChannelLogFromRR(tokenRetrievedDescription, channel, courier.NilMsgID, rr)})
+		}
+
+		return token, ttl, nil
+	}
+
+	if !channel.BoolConfigForKey(configCacheToken, true) {
+		token, _, err := fetch()
+		return token, rr, err
+	}
+
+	token, err := handlers.CachedToken(rp, channel, h.tokenKeyPrefix(), defaultTokenTTL, fetch)
+	return token, rr, err
+}
+
+// requestOrRefreshToken requests a new token for the passed in channel. Channels with use_refresh_token set get it with
+// the refresh token Hormuud gave us with their last one if we have it, falling back to their credentials if that fails.
+func (h *handler) requestOrRefreshToken(ctx context.Context, channel courier.Channel) (string, *utils.RequestResponse, error) {
+	if !channel.BoolConfigForKey(configRefreshToken, false) {
+		return requestToken(ctx, channel)
+	}
+
+	rp := h.Backend().RedisPool()
+	refresh, err := handlers.CachedRefreshToken(rp, channel, h.tokenKeyPrefix())
+	if err != nil {
+		tokenLog(channel).WithError(err).Error("error reading HM refresh token")
+	}
+	if refresh == "" {
+		return requestToken(ctx, channel)
+	}
+
+	token, rr, err := refreshToken(ctx, channel, refresh)
+	if err == nil {
+		return token, rr, nil
+	}
+
+	// our refresh token may have expired or been revoked, so forget it and use our credentials instead
+	log := tokenLog(channel).WithError(err)
+	if rr != nil {
+		log = log.WithField("status_code", rr.StatusCode)
+	}
+	log.Warn("error refreshing HM access token, falling back to password grant")
+
+	if err := handlers.ClearCachedRefreshToken(rp, channel, h.tokenKeyPrefix()); err != nil {
+		tokenLog(channel).WithError(err).Error("error clearing HM refresh token")
+	}
+	return requestToken(ctx, channel)
+}
+
+// cacheRefreshToken caches the refresh token in the passed in token response body, if the channel has use_refresh_token
+// set and Hormuud gave us one
+func (h *handler) cacheRefreshToken(channel courier.Channel, body []byte) {
+	if !channel.BoolConfigForKey(configRefreshToken, false) {
+		return
+	}
+
+	refresh, _ := jsonparser.GetString(body, "refresh_token")
+	if refresh == "" {
+		return
+	}
+
+	ttl := defaultRefreshTokenTTL
+	if expiresIn, _ := jsonparser.GetInt(body, "refresh_expires_in"); expiresIn > 0 {
+		ttl = int(expiresIn)
+	}
+
+	if err := handlers.CacheRefreshToken(h.Backend().RedisPool(), channel, h.tokenKeyPrefix(), refresh, ttl); err != nil {
+		tokenLog(channel).WithError(err).Error("error caching HM refresh token")
+	}
+}
+
+// ValidateConfig checks that Hormuud accepts the passed in channel's credentials by requesting a new token. The token
+// isn't cached so this always checks the current config.
+func (h *handler) ValidateConfig(ctx context.Context, channel courier.Channel) error {
+	_, rr, err := requestToken(ctx, channel)
+	if err != nil && rr != nil {
+		// surface Hormuud's own explanation of why our token request failed if it gave us one
+		for _, key := range []string{"error_description", "error"} {
+			reason, _ := jsonparser.GetString(rr.Body, key)
+			if reason != "" {
+				return errors.Errorf("token request failed: %s", reason)
+			}
+		}
+	}
+	return err
+}
+
+// ConfigError is returned by FetchToken when the channel is missing config needed to fetch a token, retrying won't help
+type ConfigError struct {
+	Key string
+
+	// why the config is invalid if it is set but unusable, nil if it is missing
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Invalid '%s' config for HM channel: %s", e.Key, e.Err)
+	}
+	return fmt.Sprintf("Missing '%s' config for HM channel", e.Key)
+}
+
+// TransientError is returned by FetchToken when fetching a token failed for reasons which may resolve on a retry
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// credentialForChannel returns the credential with the passed in config key for the passed in channel. Credentials can
+// be set to ${ENV:NAME} or ${SECRET:NAME} to be resolved from the environment or a secret file each time we request a
+// token, as described by handlers.ResolveConfigValue.
+func credentialForChannel(channel courier.Channel, key string) (string, error) {
+	value := channel.StringConfigForKey(key, "")
+	if value == "" {
+		return "", &ConfigError{Key: key}
+	}
+
+	resolved, err := handlers.ResolveConfigValue(value)
+	if err != nil {
+		return "", &ConfigError{Key: key, Err: err}
+	}
+	return resolved, nil
+}
+
+// httpClientForChannel returns the HTTP client we make the requests of the passed in channel with, which presents its
+// client_cert and client_key for mutual TLS if it has them. Channels with an http_proxy have their requests made
+// through it. A ConfigError is returned if the channel's TLS or proxy config is invalid.
+func httpClientForChannel(channel courier.Channel) (*http.Client, error) {
+	opts := utils.TLSOptions{InsecureSkipVerify: channel.BoolConfigForKey(configTLSInsecure, false)}
+
+	if proxy := channel.StringConfigForKey(configHTTPProxy, ""); proxy != "" {
+		proxyURL, err := utils.ParseProxyURL(proxy)
+		if err != nil {
+			return nil, &ConfigError{Key: configHTTPProxy, Err: err}
+		}
+		opts.Proxy = proxyURL
+	}
+
+	if version := channel.StringConfigForKey(configTLSMinVersion, ""); version != "" {
+		minVersion, err := utils.ParseTLSVersion(version)
+		if err != nil {
+			return nil, &ConfigError{Key: configTLSMinVersion, Err: err}
+		}
+		opts.MinVersion = minVersion
+	}
+
+	cert, key := channel.StringConfigForKey(configClientCert, ""), channel.StringConfigForKey(configClientKey, "")
+	if cert != "" || key != "" {
+		if cert == "" {
+			return nil, &ConfigError{Key: configClientCert}
+		}
+		if key == "" {
+			return nil, &ConfigError{Key: configClientKey}
+		}
+		opts.ClientCert, opts.ClientKey = cert, key
+	}
+
+	client, err := utils.GetTLSHTTPClient(opts)
+	if err != nil {
+		return nil, &ConfigError{Key: configClientCert, Err: err}
+	}
+
+	if !opts.IsDefault() {
+		channelTLSClientsMutex.Lock()
+		channelTLSClients[channel.UUID()] = opts.CacheKey()
+		channelTLSClientsMutex.Unlock()
+	}
+	return client, nil
+}
+
+// evictChannelHTTPClient drops the HTTP client we last made the requests of the passed in channel with, if it had its
+// own, so that one made with its old TLS or proxy config isn't kept around
+func evictChannelHTTPClient(channel courier.Channel) {
+	channelTLSClientsMutex.Lock()
+	key, found := channelTLSClients[channel.UUID()]
+	delete(channelTLSClients, channel.UUID())
+	channelTLSClientsMutex.Unlock()
+
+	if found {
+		utils.EvictTLSHTTPClient(key)
+	}
+}
+
+// setUserAgent sets the User-Agent of the passed in request to the one configured for the passed in channel, if any,
+// otherwise it is left to utils to send our default
+func setUserAgent(req *http.Request, channel courier.Channel) {
+	if userAgent := channel.StringConfigForKey(courier.ConfigUserAgent, ""); userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+}
+
+// requestToken requests a new token for the passed in channel from Hormuud
+func requestToken(ctx context.Context, channel courier.Channel) (string, *utils.RequestResponse, error) {
+	username, err := credentialForChannel(channel, courier.ConfigUsername)
+	if err != nil {
+		return "", nil, err
+	}
+
+	password, err := credentialForChannel(channel, courier.ConfigPassword)
+	if err != nil {
+		return "", nil, err
+	}
+
+	form := url.Values{
+		"Username":   []string{username},
+		"Password":   []string{password},
+		"grant_type": []string{"password"},
+	}
+	return postTokenRequest(ctx, channel, form)
+}
+
+// refreshToken requests a new token for the passed in channel from Hormuud with the passed in refresh token
+func refreshToken(ctx context.Context, channel courier.Channel, refresh string) (string, *utils.RequestResponse, error) {
+	form := url.Values{
+		"refresh_token": []string{refresh},
+		"grant_type":    []string{"refresh_token"},
+	}
+	return postTokenRequest(ctx, channel, form)
+}
+
+// postTokenRequest posts the passed in token request form for the passed in channel to Hormuud, returning the token
+// from its response. Channels with a token_format of json post it as a JSON object rather than form encoded.
+func postTokenRequest(ctx context.Context, channel courier.Channel, form url.Values) (string, *utils.RequestResponse, error) {
+	body, contentType, err := encodeTokenRequest(channel, form)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// build our request
+	hmTokenURL := channel.StringConfigForKey(configTokenURL, tokenURL)
+	req, err := http.NewRequest(http.MethodPost, hmTokenURL, strings.NewReader(body))
+	if err != nil {
+		return "", nil, &ConfigError{Key: configTokenURL}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	setUserAgent(req, channel)
+
+	client, err := httpClientForChannel(channel)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := withHTTPTimeout(ctx, channel)
+	defer cancel()
+
+	rr, err := utils.MakeHTTPRequestWithClient(req.WithContext(ctx), client)
+	if err != nil {
+		// Hormuud rejecting our credentials won't change on a retry, anything else might
+		if rr != nil && isCredentialsRejected(rr.StatusCode) {
+			return "", rr, &ConfigError{Key: courier.ConfigPassword, Err: errors.Errorf("token request rejected with status %d, check the username and password", rr.StatusCode)}
+		}
+		return "", rr, &TransientError{errors.Wrapf(err, "error making token request")}
+	}
+
+	token, err := jsonparser.GetString(rr.Body, "access_token")
+	if err != nil {
+		return "", rr, &TransientError{errors.Wrapf(err, "error getting access_token from response")}
+	}
+
+	if token == "" {
+		return "", rr, &TransientError{errors.Errorf("no access token returned")}
+	}
+
+	return token, rr, nil
+}
+
+// isCredentialsRejected returns whether the passed in status code of a response to a token request means Hormuud
+// rejected the credentials we sent
+func isCredentialsRejected(statusCode int) bool {
+	return statusCode == http.StatusBadRequest || statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// encodeTokenRequest encodes the passed in token request form in the token_format of the passed in channel, returning
+// the body and its content type
+func encodeTokenRequest(channel courier.Channel, form url.Values) (string, string, error) {
+	format := strings.ToLower(strings.TrimSpace(channel.StringConfigForKey(configTokenFormat, tokenFormatForm)))
+
+	switch format {
+	case tokenFormatForm:
+		return encodeTokenForm(channel, form)
+
+	case tokenFormatJSON:
+		fields := make(map[string]string, len(form))
+		for key := range form {
+			fields[key] = form.Get(key)
+		}
+		body, err := json.Marshal(fields)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "unable to encode token request")
+		}
+		return string(body), "application/json", nil
+	}
+
+	return "", "", &ConfigError{Key: configTokenFormat, Err: errors.Errorf("unknown token format: %s", format)}
+}
+
+// encodeTokenForm form encodes the passed in token request form in the token_charset of the passed in channel. Every
+// byte outside of the unreserved characters is percent encoded, so credentials containing characters like +, &, % or
+// spaces arrive intact. Gateways which decode credentials as ISO-8859-1 rather than UTF-8 get them encoded as such,
+// which credentials with characters outside of it can't be.
+func encodeTokenForm(channel courier.Channel, form url.Values) (string, string, error) {
+	charset := strings.ToLower(strings.TrimSpace(channel.StringConfigForKey(configTokenCharset, tokenCharsetUTF8)))
+	if charset == "latin1" || charset == "latin-1" {
+		charset = tokenCharsetLatin1
+	}
+
+	switch charset {
+	case tokenCharsetUTF8:
+		return form.Encode(), "application/x-www-form-urlencoded", nil
+
+	case tokenCharsetLatin1:
+		encoded := make(url.Values, len(form))
+		for key, values := range form {
+			for _, value := range values {
+				latin1, err := toLatin1(value)
+				if err != nil {
+					return "", "", &ConfigError{Key: configTokenCharset, Err: errors.Wrapf(err, "unable to encode '%s'", key)}
+				}
+				encoded.Add(key, latin1)
+			}
+		}
+		return encoded.Encode(), "application/x-www-form-urlencoded; charset=ISO-8859-1", nil
+	}
+
+	return "", "", &ConfigError{Key: configTokenCharset, Err: errors.Errorf("unknown token charset: %s", charset)}
+}
+
+// toLatin1 returns the ISO-8859-1 bytes of the passed in text, or an error if it has characters outside of it. The
+// error doesn't include the characters since the text is usually a credential.
+func toLatin1(text string) (string, error) {
+	latin1 := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xFF {
+			return "", errors.Errorf("text has characters outside of ISO-8859-1")
+		}
+		latin1 = append(latin1, byte(r))
+	}
+	return string(latin1), nil
+}
+
+// ChannelConfigChanged discards any token we cached for the passed in channel or backoff from failed token requests,
+// so that its next send fetches a token with its new credentials rather than using one fetched with its old ones, and
+// the HTTP client made with its old TLS and proxy config
+func (h *handler) ChannelConfigChanged(ctx context.Context, channel courier.Channel) error {
+	evictChannelHTTPClient(channel)
+	h.clearTokenBackoff(h.Backend().RedisPool(), channel)
+	if err := handlers.ClearCachedRefreshToken(h.Backend().RedisPool(), channel, h.tokenKeyPrefix()); err != nil {
+		return err
+	}
+	return handlers.ClearCachedToken(h.Backend().RedisPool(), channel, h.tokenKeyPrefix())
+}
+
+// tokenKeyPrefix returns the prefix of the redis keys we cache tokens under, which starts with the server's redis key
+// prefix so that deployments sharing a redis instance don't use each other's tokens
+func (h *handler) tokenKeyPrefix() string {
+	return h.RedisKeyPrefix() + tokenCachePrefix
+}
+
+// clearToken removes any cached token for the passed in channel
+func (h *handler) clearToken(channel courier.Channel) {
+	err := handlers.ClearCachedToken(h.Backend().RedisPool(), channel, h.tokenKeyPrefix())
+	if err != nil {
+		tokenLog(channel).WithError(err).Error("error clearing HM access token")
+	}
+}
+
+// inTokenBackoff returns whether we're backing off from token requests for the passed in channel
+func (h *handler) inTokenBackoff(rp *redis.Pool, channel courier.Channel) bool {
+	if rp == nil {
+		return false
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	backoff, _ := redis.Bool(conn.Do("EXISTS", h.tokenBackoffKey(channel)))
+	return backoff
+}
+
+// recordTokenFailure counts a failed token request for the passed in channel and backs off from making any more for a
+// window which doubles with each consecutive failure
+func (h *handler) recordTokenFailure(rp *redis.Pool, channel courier.Channel) {
+	if rp == nil {
+		return
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	failuresKey := h.tokenFailuresKey(channel)
+	failures, err := redis.Int(conn.Do("INCR", failuresKey))
+	if err == nil {
+		// forget about failures once we've gone a while without any
+		_, err = conn.Do("EXPIRE", failuresKey, maxTokenBackoff*2)
+	}
+	if err == nil {
+		_, err = conn.Do("SETEX", h.tokenBackoffKey(channel), tokenBackoff(failures), "1")
+	}
+	if err != nil {
+		tokenLog(channel).WithError(err).Error("error recording HM token request failure")
+	}
+}
+
+// clearTokenBackoff forgets about any failed token requests for the passed in channel
+func (h *handler) clearTokenBackoff(rp *redis.Pool, channel courier.Channel) {
+	if rp == nil {
+		return
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", h.tokenBackoffKey(channel), h.tokenFailuresKey(channel))
+	if err != nil {
+		tokenLog(channel).WithError(err).Error("error clearing HM token backoff")
+	}
+}
+
+// tokenBackoffKey returns the redis key we mark the passed in channel as backing off from token requests under
+func (h *handler) tokenBackoffKey(channel courier.Channel) string {
+	return h.RedisKeyPrefix() + tokenBackoffPrefix + channel.UUID().String()
+}
+
+// tokenFailuresKey returns the redis key we count the consecutive failed token requests of the passed in channel under
+func (h *handler) tokenFailuresKey(channel courier.Channel) string {
+	return h.RedisKeyPrefix() + tokenFailuresPrefix + channel.UUID().String()
+}
+
+// tokenBackoff returns how many seconds we back off from token requests for after the passed in number of consecutive
+// failures
+func tokenBackoff(failures int) int {
+	backoff := minTokenBackoff
+	for i := 1; i < failures && backoff < maxTokenBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxTokenBackoff {
+		backoff = maxTokenBackoff
+	}
+	return backoff
+}
+
+// tokenLog returns a log entry with the fields identifying the channel whose token we're fetching
+func tokenLog(channel courier.Channel) *logrus.Entry {
+	return logrus.WithField("channel_uuid", channel.UUID()).WithField("channel_type", channel.ChannelType())
+}
+
+// jitterTTL shortens the passed in TTL by up to tokenTTLJitter so that tokens fetched at the same time, e.g. after a
+// deploy, don't all expire at the same time. We never lengthen it as that could see us using expired tokens.
+func jitterTTL(ttl int) int {
+	return ttl - int(float64(ttl)*tokenTTLJitter*randFloat())
+}
+
+// tokenTTL returns the number of seconds we should cache a token for, preferring a channel configured TTL, then the
+// expires_in value of the token response (less our safety margin), then our default
+func tokenTTL(channel courier.Channel, body []byte) int {
+	ttl := defaultTokenTTL
+
+	expiresIn, err := jsonparser.GetInt(body, "expires_in")
+	if err == nil {
+		margin := channel.IntConfigForKey(configTokenExpiryMargin, defaultTokenExpiryMargin)
+		if int(expiresIn) > margin {
+			ttl = int(expiresIn) - margin
+		}
+	}
+
+	configTTL := channel.IntConfigForKey(configTokenTTL, 0)
+	if configTTL > 0 {
+		ttl = configTTL
+	}
+
+	return ttl
 }
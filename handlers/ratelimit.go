@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+)
+
+// the prefix of the redis keys we keep the token bucket of each channel under
+const rateLimitPrefix = "rate_limit_"
+
+var luaTakeTokens = redis.NewScript(1, `-- KEYS: [Bucket] ARGV: [MaxPerSecond, NowMS, Cost]
+	local rate = tonumber(ARGV[1])
+	local now = tonumber(ARGV[2])
+	local cost = tonumber(ARGV[3])
+
+	-- buckets we don't have are full, as are ones which have expired after going unused long enough to refill
+	local bucket = redis.call("hmget", KEYS[1], "tokens", "refilled_on")
+	local tokens = tonumber(bucket[1]) or rate
+	local refilled = tonumber(bucket[2]) or now
+
+	-- top up our bucket for the time since we last did, up to what it holds
+	if now > refilled then
+		tokens = math.min(rate, tokens + (now - refilled) * rate / 1000)
+		refilled = now
+	end
+
+	local allowed = 0
+	if tokens >= cost then
+		tokens = tokens - cost
+		allowed = 1
+	end
+
+	redis.call("hmset", KEYS[1], "tokens", tostring(tokens), "refilled_on", tostring(refilled))
+	redis.call("pexpire", KEYS[1], 2000)
+	return allowed
+`)
+
+// RateLimit takes cost tokens from the token bucket of the passed in channel, returning whether it had them. Buckets
+// hold maxPerSecond tokens and are refilled at maxPerSecond tokens a second, so bursts can never exceed maxPerSecond
+// requests in any second. A cost larger than a bucket holds is capped to the full bucket so that it can still be taken.
+// Buckets are kept under redis keys starting with keyPrefix. A maxPerSecond of zero or less, or a nil rp, means the
+// channel isn't limited.
+func RateLimit(rp *redis.Pool, channel courier.Channel, keyPrefix string, maxPerSecond int, cost int) (bool, error) {
+	return rateLimitAt(rp, channel, keyPrefix, maxPerSecond, cost, time.Now())
+}
+
+func rateLimitAt(rp *redis.Pool, channel courier.Channel, keyPrefix string, maxPerSecond int, cost int, now time.Time) (bool, error) {
+	if maxPerSecond <= 0 || rp == nil {
+		return true, nil
+	}
+	if cost > maxPerSecond {
+		cost = maxPerSecond
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s%s%s", keyPrefix, rateLimitPrefix, channel.UUID())
+	nowMS := now.UnixNano() / int64(time.Millisecond)
+
+	allowed, err := redis.Bool(luaTakeTokens.Do(conn, key, maxPerSecond, nowMS, cost))
+	if err != nil {
+		return false, err
+	}
+	return allowed, nil
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	rp := test.NewRedisPool(t)
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	take := func(channel courier.Channel, keyPrefix string, maxPerSecond int, cost int, at time.Time) bool {
+		allowed, err := rateLimitAt(rp, channel, keyPrefix, maxPerSecond, cost, at)
+		assert.NoError(t, err)
+		return allowed
+	}
+
+	// our bucket starts full, so the first two requests are allowed, the third isn't
+	assert.True(t, take(channel, "", 2, 1, now))
+	assert.True(t, take(channel, "", 2, 1, now))
+	assert.False(t, take(channel, "", 2, 1, now))
+
+	// refused requests don't take any tokens, and tokens are refilled over time, not at the start of each second
+	assert.False(t, take(channel, "", 2, 1, now.Add(400*time.Millisecond)))
+	assert.True(t, take(channel, "", 2, 1, now.Add(500*time.Millisecond)))
+	assert.False(t, take(channel, "", 2, 1, now.Add(500*time.Millisecond)))
+
+	// so bursts across a second boundary can't exceed our rate
+	assert.True(t, take(channel, "", 2, 1, now.Add(1000*time.Millisecond)))
+	assert.False(t, take(channel, "", 2, 1, now.Add(1000*time.Millisecond)))
+
+	// and a bucket which has been left alone refills to what it holds and no more
+	assert.True(t, take(channel, "", 2, 1, now.Add(10*time.Second)))
+	assert.True(t, take(channel, "", 2, 1, now.Add(10*time.Second)))
+	assert.False(t, take(channel, "", 2, 1, now.Add(10*time.Second)))
+
+	// requests can cost more than one token
+	later := now.Add(time.Minute)
+	assert.True(t, take(channel, "", 3, 2, later))
+	assert.False(t, take(channel, "", 3, 2, later))
+	assert.True(t, take(channel, "", 3, 1, later))
+
+	// and ones costing more than a bucket holds can be made once it's full
+	later = later.Add(time.Minute)
+	assert.True(t, take(channel, "", 3, 5, later))
+	assert.False(t, take(channel, "", 3, 1, later))
+
+	// other channels have their own bucket
+	other := courier.NewMockChannel("53e5aafa-8155-449d-9009-fcb30d54bd26", "AC", "2020", "US", nil)
+	assert.True(t, take(other, "", 3, 1, later))
+
+	// as do deployments with a different key prefix
+	assert.True(t, take(channel, "staging:", 3, 1, later))
+
+	// a limit of zero means no limit
+	for i := 0; i < 5; i++ {
+		assert.True(t, take(channel, "", 0, 1, later))
+	}
+
+	// as does having no redis pool
+	allowed, err := rateLimitAt(nil, channel, "", 1, 1, now)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+}
@@ -43,6 +43,7 @@ type ChannelHandleTestCase struct {
 	Attachment  *string
 	Attachments []string
 	Date        *time.Time
+	Metadata    json.RawMessage
 
 	MsgStatus *string
 
@@ -208,7 +209,11 @@ func newServer(backend courier.Backend) courier.Server {
 
 // RunChannelSendTestCases runs all the passed in test cases against the channel
 func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler courier.ChannelHandler, testCases []ChannelSendTestCase, setupBackend func(*courier.MockBackend)) {
-	mb := courier.NewMockBackend()
+	RunChannelSendTestCasesWithBackend(t, courier.NewMockBackend(), channel, handler, testCases, setupBackend)
+}
+
+// RunChannelSendTestCasesWithBackend runs all the passed in test cases against the channel using the passed in backend
+func RunChannelSendTestCasesWithBackend(t *testing.T, mb *courier.MockBackend, channel courier.Channel, handler courier.ChannelHandler, testCases []ChannelSendTestCase, setupBackend func(*courier.MockBackend)) {
 	if setupBackend != nil {
 		setupBackend(mb)
 	}
@@ -353,7 +358,12 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 
 // RunChannelTestCases runs all the passed in tests cases for the passed in channel configurations
 func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler courier.ChannelHandler, testCases []ChannelHandleTestCase) {
-	mb := courier.NewMockBackend()
+	RunChannelTestCasesWithBackend(t, courier.NewMockBackend(), channels, handler, testCases)
+}
+
+// RunChannelTestCasesWithBackend runs all the passed in tests cases for the passed in channel configurations using the
+// passed in backend
+func RunChannelTestCasesWithBackend(t *testing.T, mb *courier.MockBackend, channels []courier.Channel, handler courier.ChannelHandler, testCases []ChannelHandleTestCase) {
 	s := newServer(mb)
 
 	for _, ch := range channels {
@@ -431,6 +441,9 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 				if len(testCase.Attachments) > 0 {
 					require.Equal(testCase.Attachments, msg.Attachments())
 				}
+				if len(testCase.Metadata) > 0 {
+					require.JSONEq(string(testCase.Metadata), string(msg.Metadata()))
+				}
 				if testCase.Date != nil {
 					if msg != nil {
 						require.Equal((*testCase.Date).Local(), (*msg.ReceivedOn()).Local())
@@ -449,6 +462,7 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 
 	if !validCase.NoQueueErrorCheck {
 		t.Run("Queue Error", func(t *testing.T) {
+			mb.ClearSeenExternalIDs()
 			mb.SetErrorOnQueue(true)
 			defer mb.SetErrorOnQueue(false)
 			testHandlerRequest(t, s, validCase.URL, validCase.Headers, validCase.Data, validCase.MultipartFormFields, 400, Sp("unable to queue message"), validCase.PrepRequest)
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/librato"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// TokenFetchFunc fetches a new token for a channel, returning it along with the number of seconds it can be cached
+// for. A TTL of zero or less means the default TTL passed to CachedToken is used.
+type TokenFetchFunc func() (string, int, error)
+
+// the fetches currently in flight, keyed by cache key
+var tokenFetches singleflight.Group
+
+// used to only warn once about having no redis pool to cache tokens in
+var warnNoTokenCache sync.Once
+
+// reports our token cache hits and misses, does nothing unless librato is configured
+var tokenCacheGauge = librato.Gauge
+
+// CachedToken returns the token cached in Redis under the passed in prefix for the passed in channel. If there is no
+// cached token, fetch is called to get a new one which is cached for the TTL it returns, or ttl if it doesn't return one.
+// Concurrent callers for the same channel and prefix share a single call to fetch. If rp is nil, tokens aren't cached
+// and fetch is called every time.
+func CachedToken(rp *redis.Pool, channel courier.Channel, prefix string, ttl int, fetch TokenFetchFunc) (string, error) {
+	// without redis we can't cache so every call has to fetch a new token
+	if rp == nil {
+		warnNoTokenCache.Do(func() { logrus.Warn("no redis pool available, tokens will not be cached") })
+
+		token, _, err := fetch()
+		return token, err
+	}
+
+	key := tokenCacheKey(prefix, channel)
+
+	// first check whether we have it in redis
+	conn := rp.Get()
+	token, _ := redis.String(conn.Do("GET", key))
+	conn.Close()
+
+	// got a token, use it
+	if token != "" {
+		reportTokenCache(channel, true)
+		return token, nil
+	}
+
+	// no token, fetch one, making sure only one fetch per channel is in flight at a time
+	result, err, _ := tokenFetches.Do(key, func() (interface{}, error) {
+		// another caller may have cached a token between our check above and us starting this fetch
+		conn := rp.Get()
+		token, _ := redis.String(conn.Do("GET", key))
+		conn.Close()
+
+		if token != "" {
+			reportTokenCache(channel, true)
+			return token, nil
+		}
+
+		reportTokenCache(channel, false)
+
+		token, tokenTTL, err := fetch()
+		if err != nil {
+			return "", err
+		}
+
+		if tokenTTL <= 0 {
+			tokenTTL = ttl
+		}
+
+		conn = rp.Get()
+		_, err = conn.Do("SETEX", key, tokenTTL, token)
+		conn.Close()
+
+		if err != nil {
+			logrus.WithError(err).WithField("channel_uuid", channel.UUID()).WithField("channel_type", channel.ChannelType()).Error("error caching access token")
+		}
+
+		return token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+// ClearCachedToken removes any token cached in Redis under the passed in prefix for the passed in channel
+func ClearCachedToken(rp *redis.Pool, channel courier.Channel, prefix string) error {
+	if rp == nil {
+		return nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", tokenCacheKey(prefix, channel))
+	return err
+}
+
+// CachedRefreshToken returns the refresh token cached in Redis under the passed in prefix for the passed in channel,
+// or an empty string if there isn't one
+func CachedRefreshToken(rp *redis.Pool, channel courier.Channel, prefix string) (string, error) {
+	if rp == nil {
+		return "", nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("GET", refreshTokenCacheKey(prefix, channel)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return token, err
+}
+
+// CacheRefreshToken caches the passed in refresh token in Redis under the passed in prefix for the passed in channel
+// for ttl seconds, so that new tokens can be requested with it rather than with the channel's credentials
+func CacheRefreshToken(rp *redis.Pool, channel courier.Channel, prefix string, token string, ttl int) error {
+	if rp == nil {
+		return nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", refreshTokenCacheKey(prefix, channel), ttl, token)
+	return err
+}
+
+// ClearCachedRefreshToken removes any refresh token cached in Redis under the passed in prefix for the passed in channel
+func ClearCachedRefreshToken(rp *redis.Pool, channel courier.Channel, prefix string) error {
+	if rp == nil {
+		return nil
+	}
+
+	conn := rp.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", refreshTokenCacheKey(prefix, channel))
+	return err
+}
+
+func reportTokenCache(channel courier.Channel, hit bool) {
+	if hit {
+		tokenCacheGauge(fmt.Sprintf("courier.token_cache_hit_%s", channel.ChannelType()), float64(1))
+	} else {
+		tokenCacheGauge(fmt.Sprintf("courier.token_cache_miss_%s", channel.ChannelType()), float64(1))
+	}
+}
+
+func tokenCacheKey(prefix string, channel courier.Channel) string {
+	return fmt.Sprintf("%s%s", prefix, channel.UUID())
+}
+
+func refreshTokenCacheKey(prefix string, channel courier.Channel) string {
+	return fmt.Sprintf("%srefresh_%s", prefix, channel.UUID())
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/librato"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedToken(t *testing.T) {
+	rp := courier.NewMockBackend().RedisPool()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	gauges := make(map[string]float64)
+	tokenCacheGauge = func(name string, value float64) { gauges[name] += value }
+	defer func() { tokenCacheGauge = librato.Gauge }()
+
+	fetches := 0
+	fetch := func() (string, int, error) {
+		fetches++
+		return "token1", 0, nil
+	}
+
+	// no token cached, so we fetch one
+	token, err := CachedToken(rp, channel, "ac_token_", 600, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	assert.Equal(t, 1, fetches)
+
+	// which is now cached with our default TTL
+	conn := rp.Get()
+	ttl, _ := redis.Int(conn.Do("TTL", "ac_token_8eb23e93-5ecb-45ba-b726-3b064e0c56ab"))
+	conn.Close()
+	assert.Equal(t, 600, ttl)
+
+	token, err = CachedToken(rp, channel, "ac_token_", 600, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	assert.Equal(t, 1, fetches)
+
+	// we record one miss and one hit
+	assert.Equal(t, map[string]float64{"courier.token_cache_miss_AC": 1, "courier.token_cache_hit_AC": 1}, gauges)
+
+	// clear it and we fetch again, this time using the TTL returned by our fetch
+	assert.NoError(t, ClearCachedToken(rp, channel, "ac_token_"))
+
+	token, err = CachedToken(rp, channel, "ac_token_", 600, func() (string, int, error) { return "token2", 30, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "token2", token)
+
+	conn = rp.Get()
+	ttl, _ = redis.Int(conn.Do("TTL", "ac_token_8eb23e93-5ecb-45ba-b726-3b064e0c56ab"))
+	conn.Close()
+	assert.Equal(t, 30, ttl)
+
+	// fetch errors are returned and nothing is cached
+	assert.NoError(t, ClearCachedToken(rp, channel, "ac_token_"))
+
+	token, err = CachedToken(rp, channel, "ac_token_", 600, func() (string, int, error) { return "", 0, errors.New("boom") })
+	assert.EqualError(t, err, "boom")
+	assert.Equal(t, "", token)
+
+	token, err = CachedToken(rp, channel, "ac_token_", 600, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestCachedTokenWithoutRedis(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	fetches := 0
+	fetch := func() (string, int, error) {
+		fetches++
+		return "token1", 0, nil
+	}
+
+	// without a pool nothing is cached so we fetch every time
+	for i := 0; i < 2; i++ {
+		token, err := CachedToken(nil, channel, "ac_token_", 600, fetch)
+		assert.NoError(t, err)
+		assert.Equal(t, "token1", token)
+	}
+	assert.Equal(t, 2, fetches)
+
+	assert.NoError(t, ClearCachedToken(nil, channel, "ac_token_"))
+
+	_, err := CachedToken(nil, channel, "ac_token_", 600, func() (string, int, error) { return "", 0, errors.New("boom") })
+	assert.EqualError(t, err, "boom")
+}
+
+func TestCachedRefreshToken(t *testing.T) {
+	rp := courier.NewMockBackend().RedisPool()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	// nothing cached yet
+	token, err := CachedRefreshToken(rp, channel, "ac_token_")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+
+	assert.NoError(t, CacheRefreshToken(rp, channel, "ac_token_", "refresh1", 600))
+
+	token, err = CachedRefreshToken(rp, channel, "ac_token_")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh1", token)
+
+	// which is cached separately from our access token with its own TTL
+	conn := rp.Get()
+	ttl, _ := redis.Int(conn.Do("TTL", "ac_token_refresh_8eb23e93-5ecb-45ba-b726-3b064e0c56ab"))
+	conn.Close()
+	assert.Equal(t, 600, ttl)
+
+	assert.NoError(t, ClearCachedToken(rp, channel, "ac_token_"))
+	token, _ = CachedRefreshToken(rp, channel, "ac_token_")
+	assert.Equal(t, "refresh1", token)
+
+	assert.NoError(t, ClearCachedRefreshToken(rp, channel, "ac_token_"))
+	token, _ = CachedRefreshToken(rp, channel, "ac_token_")
+	assert.Equal(t, "", token)
+
+	// without a pool nothing is cached
+	assert.NoError(t, CacheRefreshToken(nil, channel, "ac_token_", "refresh1", 600))
+	token, err = CachedRefreshToken(nil, channel, "ac_token_")
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+	assert.NoError(t, ClearCachedRefreshToken(nil, channel, "ac_token_"))
+}
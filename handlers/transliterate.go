@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/nyaruka/gocommon/gsm7"
+	"golang.org/x/text/unicode/norm"
+)
+
+// arabicTransliterations are the Latin equivalents we use for Arabic script, including the extra letters of Persian and
+// Urdu, and its punctuation and digits. Short vowels are marks and are dropped along with all other marks.
+var arabicTransliterations = map[rune]string{
+	'ء': "'", 'آ': "aa", 'أ': "a", 'ؤ': "'", 'إ': "i", 'ئ': "'", 'ا': "a", 'ب': "b", 'ة': "h", 'ت': "t", 'ث': "th",
+	'ج': "j", 'ح': "h", 'خ': "kh", 'د': "d", 'ذ': "dh", 'ر': "r", 'ز': "z", 'س': "s", 'ش': "sh", 'ص': "s", 'ض': "d",
+	'ط': "t", 'ظ': "z", 'ع': "'", 'غ': "gh", 'ف': "f", 'ق': "q", 'ك': "k", 'ل': "l", 'م': "m", 'ن': "n", 'ه': "h",
+	'و': "w", 'ى': "a", 'ي': "y", 'پ': "p", 'چ': "ch", 'ژ': "zh", 'ک': "k", 'گ': "g", 'ی': "y", 'ـ': "",
+	'،': ",", '؛': ";", '؟': "?", '٪': "%",
+	'٠': "0", '١': "1", '٢': "2", '٣': "3", '٤': "4", '٥': "5", '٦': "6", '٧': "7", '٨': "8", '٩': "9",
+	'۰': "0", '۱': "1", '۲': "2", '۳': "3", '۴': "4", '۵': "5", '۶': "6", '۷': "7", '۸': "8", '۹': "9",
+}
+
+// TransliterateGSM7 returns the passed in text with the characters that can't be encoded using the GSM 03.38 alphabet
+// replaced by their closest equivalents that can, e.g. Arabic script by Latin and accented letters missing from the
+// alphabet by the letters without their accents. Characters which can be encoded are left alone. If there's anything
+// we don't have an equivalent for, e.g. emoji, the original text is returned along with false.
+func TransliterateGSM7(text string) (string, bool) {
+	if gsm7.IsValid(text) {
+		return text, true
+	}
+
+	transliterated := strings.Builder{}
+	for _, r := range text {
+		if gsm7.IsValid(string(r)) {
+			transliterated.WriteRune(r)
+			continue
+		}
+
+		if latin, found := arabicTransliterations[r]; found {
+			transliterated.WriteString(latin)
+			continue
+		}
+
+		// decompose anything else into its base letter and marks, dropping the marks
+		stripped := strings.Map(func(r rune) rune {
+			if unicode.Is(unicode.Mn, r) {
+				return -1
+			}
+			return r
+		}, norm.NFD.String(string(r)))
+
+		// characters which are only marks are dropped entirely but anything left needs to be encodable
+		if stripped != "" && !gsm7.IsValid(stripped) {
+			return text, false
+		}
+		transliterated.WriteString(stripped)
+	}
+
+	return transliterated.String(), true
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransliterateGSM7(t *testing.T) {
+	tcs := []struct {
+		text           string
+		transliterated string
+		valid          bool
+	}{
+		{"Hello world", "Hello world", true},
+		{"Café ñandú", "Café ñandu", true},
+		{"Ça coûte 5€", "Ça coute 5€", true},
+		{"łódź", "łodz", false},
+		{"مرحبا", "mrhba", true},
+		{"مَرْحَبًا بِكُمْ", "mrhba bkm", true},
+		{"رقمك هو ١٢٣٤؟", "rqmk hw 1234?", true},
+		{"سلام دوست", "slam dwst", true},
+		{"مرحبا 😀", "مرحبا 😀", false},
+	}
+
+	for _, tc := range tcs {
+		transliterated, valid := TransliterateGSM7(tc.text)
+		assert.Equal(t, tc.valid, valid, "valid mismatch for '%s'", tc.text)
+		if tc.valid {
+			assert.Equal(t, tc.transliterated, transliterated, "transliteration mismatch for '%s'", tc.text)
+		} else {
+			assert.Equal(t, tc.text, transliterated, "original not returned for '%s'", tc.text)
+		}
+	}
+}
@@ -387,7 +387,7 @@ func uploadMediaToTwitter(msg courier.Msg, mediaUrl string, attachmentMimeType s
 
 	// retrieve the media to be sent from S3
 	req, _ := http.NewRequest(http.MethodGet, attachmentURL, nil)
-	s3rr, err := utils.MakeHTTPRequest(req)
+	s3rr, err := utils.MakeMediaHTTPRequest(req)
 	log := courier.NewChannelLogFromRR("Media Fetch", msg.Channel(), msg.ID(), s3rr)
 	if err != nil {
 		log.WithError("Media Fetch Error", err)
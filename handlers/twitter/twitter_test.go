@@ -11,6 +11,7 @@ import (
 
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/utils"
 )
 
 var testChannels = []courier.Channel{
@@ -443,3 +444,62 @@ func TestSending(t *testing.T) {
 	attachmentMockedSendTestCase := mockAttachmentURLs(mediaServer, defaultSendTestCases)
 	RunChannelSendTestCases(t, testChannels[0], newHandler("TWT", "Twitter Activity"), attachmentMockedSendTestCase, nil)
 }
+
+var largeMediaSendTestCases = []ChannelSendTestCase{
+	{Label: "Large Image Send",
+		Text:   "",
+		URN:    "twitterid:12345",
+		Status: "W", ExternalID: "133",
+		Attachments: []string{"image/jpeg:https://foo.bar/image.jpg"},
+		Responses: map[MockedRequest]MockedResponse{
+			MockedRequest{
+				Method: "POST",
+				Path:   "/1.1/media/upload.json",
+				Body:   `command=INIT&media_category=dm_image&media_type=image%2Fjpeg&total_bytes=500`,
+			}: MockedResponse{
+				Status: 200,
+				Body:   `{"media_id": 710511363345354753, "media_id_string": "710511363345354753"}`,
+			},
+			MockedRequest{
+				Method:       "POST",
+				Path:         "/1.1/media/upload.json",
+				BodyContains: "APPEND",
+			}: MockedResponse{
+				Status: 200,
+				Body:   `{"media_id": 710511363345354753, "media_id_string": "710511363345354753"}`,
+			},
+			MockedRequest{
+				Method: "POST",
+				Path:   "/1.1/media/upload.json",
+				Body:   `command=FINALIZE&media_id=710511363345354753`,
+			}: MockedResponse{
+				Status: 200,
+				Body:   `{"media_id": 710511363345354753, "media_id_string": "710511363345354753"}`,
+			},
+			MockedRequest{
+				Method: "POST",
+				Path:   "/1.1/direct_messages/events/new.json",
+				Body:   `{"event":{"type":"message_create","message_create":{"target":{"recipient_id":"12345"},"message_data":{"text":"","attachment":{"type":"media","media":{"id":"710511363345354753"}}}}}}`,
+			}: MockedResponse{
+				Status: 200,
+				Body:   `{"event": { "id": "133"}}`,
+			},
+		},
+		SendPrep: setSendURL,
+	},
+}
+
+func TestSendingLargeMedia(t *testing.T) {
+	// media bigger than we'd read of any other response should still be uploaded in full
+	defer func(original int) { utils.MaxResponseBodyBytes = original }(utils.MaxResponseBodyBytes)
+	utils.MaxResponseBodyBytes = 200
+
+	mediaServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		res.WriteHeader(200)
+		res.Write([]byte(strings.Repeat("x", 500)))
+	}))
+	defer mediaServer.Close()
+
+	RunChannelSendTestCases(t, testChannels[0], newHandler("TWT", "Twitter Activity"), mockAttachmentURLs(mediaServer, largeMediaSendTestCases), nil)
+}
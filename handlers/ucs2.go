@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// ucs2Units returns the number of UTF-16 code units needed to encode the passed in rune, which is two for characters
+// outside the basic multilingual plane, like most emoji, as they are encoded as surrogate pairs
+func ucs2Units(r rune) int {
+	if r > 0xFFFF && r <= unicode.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+// UCS2Units returns the number of UTF-16 code units needed to encode the passed in text, which is how the length of
+// messages sent as UCS-2 is measured
+func UCS2Units(text string) int {
+	units := 0
+	for _, r := range text {
+		units += ucs2Units(r)
+	}
+	return units
+}
+
+// SplitMsgUCS2 splits the passed in text into parts which are each at most max UTF-16 code units long. Like SplitMsg
+// we prefer to split on a space close to the end of a part, but surrogate pairs are never split across parts.
+func SplitMsgUCS2(text string, max int) []string {
+	// smaller than our max, just return it
+	if UCS2Units(text) <= max {
+		return []string{text}
+	}
+
+	parts := make([]string, 0, 2)
+	part := bytes.Buffer{}
+	partLength := 0
+	for _, r := range text {
+		units := ucs2Units(r)
+
+		// surrogate pairs can't be split across parts
+		if partLength+units > max {
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+			partLength = 0
+		}
+
+		part.WriteRune(r)
+		partLength += units
+
+		if partLength == max || (partLength > max-6 && r == ' ') {
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+			partLength = 0
+		}
+	}
+	if part.Len() > 0 {
+		parts = append(parts, strings.TrimSpace(part.String()))
+	}
+
+	return parts
+}
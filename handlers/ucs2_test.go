@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUCS2Units(t *testing.T) {
+	assert.Equal(t, 0, UCS2Units(""))
+	assert.Equal(t, 5, UCS2Units("hello"))
+	assert.Equal(t, 5, UCS2Units("مرحبا"))
+	assert.Equal(t, 2, UCS2Units("🙂"))
+	assert.Equal(t, 8, UCS2Units("hi 🙂 ☺!"))
+}
+
+func TestSplitMsgUCS2(t *testing.T) {
+	// 35 emoji are 70 units so fit a single part, 36 don't
+	assert.Equal(t, []string{strings.Repeat("🙂", 35)}, SplitMsgUCS2(strings.Repeat("🙂", 35), 70))
+	assert.Equal(t, []string{strings.Repeat("🙂", 33), strings.Repeat("🙂", 3)}, SplitMsgUCS2(strings.Repeat("🙂", 36), 67))
+
+	// surrogate pairs are never split across parts
+	assert.Equal(t, []string{"ab", "🙂", "🙂"}, SplitMsgUCS2("ab🙂🙂", 3))
+	assert.Equal(t, []string{"a🙂", "b🙂"}, SplitMsgUCS2("a🙂b🙂", 3))
+
+	// we split on spaces close to the end of a part like SplitMsg
+	assert.Equal(t, []string{"مرحبا", "بالعالم"}, SplitMsgUCS2("مرحبا بالعالم", 8))
+}
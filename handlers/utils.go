@@ -24,6 +24,62 @@ func GetTextAndAttachments(m courier.Msg) string {
 	return buf.String()
 }
 
+// QuickReplyAdapter converts the quick reply at the passed in index to the structure a provider expects for it
+type QuickReplyAdapter func(index int, text string) interface{}
+
+// BuildQuickReplies converts each of the quick replies of our message using the passed in adapter, returning nil if
+// it has none. Providers without native quick reply support should use TextWithQuickReplies instead.
+func BuildQuickReplies(m courier.Msg, adapter QuickReplyAdapter) []interface{} {
+	qrs := m.QuickReplies()
+	if len(qrs) == 0 {
+		return nil
+	}
+
+	replies := make([]interface{}, len(qrs))
+	for i, qr := range qrs {
+		replies[i] = adapter(i, qr)
+	}
+	return replies
+}
+
+// TextWithQuickReplies returns the passed in text with the passed in quick replies appended as numbered options, for
+// providers which have no native way of sending them, e.g. "Are you happy?\n\n1. Yes\n2. No"
+func TextWithQuickReplies(text string, quickReplies []string) string {
+	if len(quickReplies) == 0 {
+		return text
+	}
+
+	buf := bytes.NewBufferString(text)
+	if text != "" {
+		buf.WriteString("\n")
+	}
+	for i, qr := range quickReplies {
+		buf.WriteString(fmt.Sprintf("\n%d. %s", i+1, qr))
+	}
+	return strings.TrimPrefix(buf.String(), "\n")
+}
+
+var templatePlaceholderRegex = regexp.MustCompile(`\{\{(\d+)\}\}`)
+
+// ApplyTemplate returns the passed in template with each of its {{1}} style placeholders replaced by the value at that
+// position in the passed in values. Placeholders are only looked for in the template itself, so values containing
+// placeholders are included as is rather than being substituted in turn. An error is returned if the template has a
+// placeholder we don't have a value for.
+func ApplyTemplate(template string, values []string) (string, error) {
+	var err error
+	text := templatePlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		index, _ := strconv.Atoi(templatePlaceholderRegex.FindStringSubmatch(placeholder)[1])
+		if index < 1 || index > len(values) {
+			if err == nil {
+				err = fmt.Errorf("no value for template placeholder %s, have %d values", placeholder, len(values))
+			}
+			return placeholder
+		}
+		return values[index-1]
+	})
+	return text, err
+}
+
 // SplitAttachment takes an attachment string and returns the media type and URL for the attachment
 func SplitAttachment(attachment string) (string, string) {
 	parts := strings.SplitN(attachment, ":", 2)
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildQuickReplies(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	type button struct {
+		ID    int    `json:"id"`
+		Title string `json:"title"`
+	}
+	adapter := func(i int, text string) interface{} { return button{i, text} }
+
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Are you happy?", false, []string{"Yes", "No"}, "", 0, "")
+	assert.Equal(t, []interface{}{button{0, "Yes"}, button{1, "No"}}, BuildQuickReplies(msg, adapter))
+
+	msg = mb.NewOutgoingMsg(channel, courier.NewMsgID(10), urns.URN("tel:+250788383383"), "Are you happy?", false, nil, "", 0, "")
+	assert.Nil(t, BuildQuickReplies(msg, adapter))
+}
+
+func TestTextWithQuickReplies(t *testing.T) {
+	assert.Equal(t, "Are you happy?", TextWithQuickReplies("Are you happy?", nil))
+	assert.Equal(t, "Are you happy?\n\n1. Yes\n2. No", TextWithQuickReplies("Are you happy?", []string{"Yes", "No"}))
+	assert.Equal(t, "1. Yes\n2. No", TextWithQuickReplies("", []string{"Yes", "No"}))
+}
+
+func TestApplyTemplate(t *testing.T) {
+	tcs := []struct {
+		template string
+		values   []string
+		text     string
+		err      string
+	}{
+		{"Hi there", nil, "Hi there", ""},
+		{"Hi {{1}}, your code is {{2}}", []string{"Bob", "1234"}, "Hi Bob, your code is 1234", ""},
+		{"{{2}} before {{1}}, {{2}} again", []string{"one", "two"}, "two before one, two again", ""},
+		{"Hi {{1}}", []string{"{{2}}", "secret"}, "Hi {{2}}", ""},
+		{"Hi {{ 1 }} {1}", []string{"Bob"}, "Hi {{ 1 }} {1}", ""},
+		{"Hi {{1}}, your code is {{2}}", []string{"Bob"}, "Hi Bob, your code is {{2}}", "no value for template placeholder {{2}}, have 1 values"},
+		{"Hi {{0}}", []string{"Bob"}, "Hi {{0}}", "no value for template placeholder {{0}}, have 1 values"},
+	}
+
+	for _, tc := range tcs {
+		text, err := ApplyTemplate(tc.template, tc.values)
+		assert.Equal(t, tc.text, text, "text mismatch for template '%s'", tc.template)
+		if tc.err == "" {
+			assert.NoError(t, err, "unexpected error for template '%s'", tc.template)
+		} else {
+			assert.EqualError(t, err, tc.err, "error mismatch for template '%s'", tc.template)
+		}
+	}
+}
@@ -648,7 +648,7 @@ func (h *handler) fetchMediaID(msg courier.Msg, mimeType, mediaURL string) (stri
 	if err != nil {
 		return "", logs, errors.Wrapf(err, "error building media request")
 	}
-	rr, err := utils.MakeHTTPRequest(req)
+	rr, err := utils.MakeMediaHTTPRequest(req)
 	log := courier.NewChannelLogFromRR("Fetching media", msg.Channel(), msg.ID(), rr).WithError("error fetching media", err)
 	logs = append(logs, log)
 	if err != nil {
@@ -11,6 +11,7 @@ import (
 
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/utils"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -615,6 +616,34 @@ var mediaCacheSendTestCases = []ChannelSendTestCase{
 	},
 }
 
+var largeMediaSendTestCases = []ChannelSendTestCase{
+	{Label: "Large Media Upload",
+		Text:   "video caption",
+		URN:    "whatsapp:250788123123",
+		Status: "W", ExternalID: "157b5e14568e8",
+		Attachments: []string{"video/mp4:https://foo.bar/large.mp4"},
+		Responses: map[MockedRequest]MockedResponse{
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/media",
+				Body:   strings.Repeat("media bytes ", 20),
+			}: MockedResponse{
+				Status: 200,
+				Body:   `{ "media" : [{"id": "36c484d1-1283-4b94-988d-7276bdec4de2"}] }`,
+			},
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/messages",
+				Body:   `{"to":"250788123123","type":"video","video":{"id":"36c484d1-1283-4b94-988d-7276bdec4de2","caption":"video caption"}}`,
+			}: MockedResponse{
+				Status: 201,
+				Body:   `{ "messages": [{"id": "157b5e14568e8"}] }`,
+			},
+		},
+		SendPrep: setSendURL,
+	},
+}
+
 var hsmSupportSendTestCases = []ChannelSendTestCase{
 	{Label: "Template Send",
 		Text:   "templated message",
@@ -686,3 +715,25 @@ func TestSending(t *testing.T) {
 
 	RunChannelSendTestCases(t, defaultChannel, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), mediaCacheSendTestCases, nil)
 }
+
+func TestSendingLargeMedia(t *testing.T) {
+	var defaultChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "WA", "250788383383", "US",
+		map[string]interface{}{
+			"auth_token":   "token123",
+			"base_url":     "https://foo.bar/",
+			"fb_namespace": "waba_namespace",
+		})
+
+	// media bigger than we'd read of any other response should still be uploaded in full
+	defer func(original int) { utils.MaxResponseBodyBytes = original }(utils.MaxResponseBodyBytes)
+	utils.MaxResponseBodyBytes = 100
+
+	mediaServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		res.WriteHeader(200)
+		res.Write([]byte(strings.Repeat("media bytes ", 20)))
+	}))
+	defer mediaServer.Close()
+
+	RunChannelSendTestCases(t, defaultChannel, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), mockAttachmentURLs(mediaServer, largeMediaSendTestCases), nil)
+}
@@ -94,6 +94,7 @@ type Msg interface {
 	ContactName() string
 	QuickReplies() []string
 	Topic() string
+	Campaign() string
 	Metadata() json.RawMessage
 	ResponseToID() MsgID
 	ResponseToExternalID() string
@@ -20,6 +20,13 @@ func writeAndLogRequestError(ctx context.Context, w http.ResponseWriter, r *http
 	return WriteError(ctx, w, r, err)
 }
 
+// writeAndLogRequestPanic writes a 500 JSON response for a request whose handler panicked, the passed in error is
+// logged but never included in the response
+func writeAndLogRequestPanic(ctx context.Context, w http.ResponseWriter, r *http.Request, c Channel, err error) error {
+	LogRequestError(r, c, err)
+	return WriteDataResponse(ctx, w, http.StatusInternalServerError, "Error", []interface{}{NewErrorData("internal error handling request")})
+}
+
 // WriteError writes a JSON response for the passed in error
 func WriteError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) error {
 	errors := []interface{}{NewErrorData(err.Error())}
@@ -44,6 +51,13 @@ func WriteAndLogUnauthorized(ctx context.Context, w http.ResponseWriter, r *http
 	return WriteDataResponse(ctx, w, http.StatusUnauthorized, "Unauthorized", []interface{}{NewErrorData(err.Error())})
 }
 
+// WriteAndLogForbidden writes a 403 JSON response for the passed in error and logs the error, the response and so the
+// error being recorded in the channel log of the request
+func WriteAndLogForbidden(ctx context.Context, w http.ResponseWriter, r *http.Request, c Channel, err error) error {
+	LogRequestError(r, c, err)
+	return WriteDataResponse(ctx, w, http.StatusForbidden, "Forbidden", []interface{}{NewErrorData(err.Error())})
+}
+
 // WriteChannelEventSuccess writes a JSON response for the passed in event indicating we handled it
 func WriteChannelEventSuccess(ctx context.Context, w http.ResponseWriter, r *http.Request, event ChannelEvent) error {
 	return WriteDataResponse(ctx, w, http.StatusOK, "Event Accepted", []interface{}{NewEventReceiveData(event)})
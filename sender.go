@@ -213,8 +213,11 @@ func (w *Sender) sendMessage(msg Msg) {
 
 		// report to librato and log locally
 		if status.Status() == MsgErrored || status.Status() == MsgFailed {
-			log.WithField("elapsed", duration).Warning("msg errored")
+			log.WithField("elapsed", duration).WithField("reason", status.Reason()).Warning("msg errored")
 			librato.Gauge(fmt.Sprintf("courier.msg_send_error_%s", msg.Channel().ChannelType()), secondDuration)
+			if status.Reason() != NilMsgStatusReason {
+				librato.Gauge(fmt.Sprintf("courier.msg_send_error_%s_%s", msg.Channel().ChannelType(), status.Reason()), secondDuration)
+			}
 		} else {
 			log.WithField("elapsed", duration).Info("msg sent")
 			librato.Gauge(fmt.Sprintf("courier.msg_send_%s", msg.Channel().ChannelType()), secondDuration)
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"compress/flate"
 	"context"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -65,9 +64,8 @@ func NewServerWithLogger(config *Config, backend Backend, logger *logrus.Logger)
 	router.Use(middleware.Timeout(30 * time.Second))
 
 	chanRouter := chi.NewRouter()
-	router.Mount("/c/", chanRouter)
 
-	return &server{
+	s := &server{
 		config:  config,
 		backend: backend,
 
@@ -78,6 +76,12 @@ func NewServerWithLogger(config *Config, backend Backend, logger *logrus.Logger)
 		waitGroup: &sync.WaitGroup{},
 		stopped:   false,
 	}
+
+	// channel routes are often configured by hand on the provider side, so always tell callers which methods they take
+	chanRouter.MethodNotAllowed(s.handle405)
+	router.Mount("/c/", chanRouter)
+
+	return s
 }
 
 // Start starts the Server listening for incoming requests and sending messages. It will return an error
@@ -86,6 +90,7 @@ func NewServerWithLogger(config *Config, backend Backend, logger *logrus.Logger)
 func (s *server) Start() error {
 	// set our user agent, needs to happen before we do anything so we don't change have threading issues
 	utils.HTTPUserAgent = fmt.Sprintf("Courier/%s", s.config.Version)
+	utils.MaxResponseBodyBytes = s.config.MaxResponseBodyBytes
 
 	// configure librato if we have configuration options for it
 	host, _ := os.Hostname()
@@ -244,7 +249,7 @@ func (s *server) initializeChannelHandlers() {
 	excludes := s.config.ExcludeChannels
 
 	// initialize handlers which are included/not-excluded in the config
-	for _, handler := range registeredHandlers {
+	for _, handler := range RegisteredHandlers() {
 		channelType := string(handler.ChannelType())
 		if (includes == nil || utils.StringArrayContains(includes, channelType)) && (excludes == nil || !utils.StringArrayContains(excludes, channelType)) {
 			err := handler.Initialize(s)
@@ -273,6 +278,41 @@ func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc Channe
 		ctx, cancel := context.WithTimeout(baseCtx, time.Second*30)
 		defer cancel()
 
+		var channel Channel
+		var request []byte
+		var logs []*ChannelLog
+		url := fmt.Sprintf("https://%s%s", r.Host, r.URL.RequestURI())
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		response := &bytes.Buffer{}
+
+		defer func() {
+			// catch any panics so that a malformed request can't take down the worker, log them with our channel and
+			// respond with a plain 500 which doesn't leak any details of what went wrong
+			panicVal := recover()
+			if panicVal == nil {
+				return
+			}
+
+			log := logrus.WithField("url", url).WithField("request", string(request)).WithField("panic", fmt.Sprint(panicVal)).WithField("stack", string(debug.Stack()))
+			if channel != nil {
+				log = log.WithField("channel_uuid", channel.UUID()).WithField("channel_type", channel.ChannelType())
+			}
+			log.Error("panic handling request")
+
+			panicErr := fmt.Errorf("panic handling request: %v", panicVal)
+			if ww.Status() == 0 {
+				writeAndLogRequestPanic(ctx, ww, r, channel, panicErr)
+			}
+
+			if channel != nil {
+				logs = append(logs, NewChannelLog("Channel Error", channel, NilMsgID, r.Method, url, ww.Status(), string(request), prependHeaders(response.String(), ww.Status(), w), time.Now().Sub(start), panicErr))
+				librato.Gauge(fmt.Sprintf("courier.channel_error_%s", channel.ChannelType()), float64(time.Now().Sub(start))/float64(time.Second))
+				if err := s.backend.WriteChannelLogs(ctx, logs); err != nil {
+					logrus.WithError(err).Error("error writing channel log")
+				}
+			}
+		}()
+
 		channel, err := handler.GetChannel(ctx, r)
 		if err != nil {
 			WriteError(ctx, w, r, err)
@@ -282,31 +322,17 @@ func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc Channe
 		r = r.WithContext(ctx)
 
 		// read the bytes from our body so we can create a channel log for this request
-		response := &bytes.Buffer{}
-
 		// Trim out cookie header, should never be part of authentication and can leak auth to channel logs
 		r.Header.Del("Cookie")
-		request, err := httputil.DumpRequest(r, true)
+		request, err = httputil.DumpRequest(r, true)
 		if err != nil {
 			writeAndLogRequestError(ctx, w, r, channel, err)
 			return
 		}
-		url := fmt.Sprintf("https://%s%s", r.Host, r.URL.RequestURI())
-		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
 		ww.Tee(response)
 
-		logs := make([]*ChannelLog, 0, 1)
-
-		defer func() {
-			// catch any panics and recover
-			panicLog := recover()
-			if panicLog != nil {
-				debug.PrintStack()
-				logrus.WithError(err).WithField("channel_uuid", channel.UUID()).WithField("url", url).WithField("request", string(request)).WithField("trace", panicLog).Error("panic handling request")
-				writeAndLogRequestError(ctx, ww, r, channel, errors.New("panic handling msg"))
-			}
-		}()
+		logs = make([]*ChannelLog, 0, 1)
 
 		events, err := handlerFunc(ctx, channel, ww, r)
 		duration := time.Now().Sub(start)
@@ -408,6 +434,9 @@ func (s *server) handle404(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) handle405(w http.ResponseWriter, r *http.Request) {
 	logrus.WithField("url", r.URL.String()).WithField("method", r.Method).WithField("resp_status", "405").Info("invalid method")
+	if allowed := s.allowedMethods(r.URL.Path); len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
 	errors := []interface{}{NewErrorData(fmt.Sprintf("method not allowed: %s", r.Method))}
 	err := WriteDataResponse(context.Background(), w, http.StatusMethodNotAllowed, "Method Not Allowed", errors)
 	if err != nil {
@@ -415,6 +444,25 @@ func (s *server) handle405(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// the methods we check for when telling callers which methods a route takes
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// allowedMethods returns the methods our router has routes for at the passed in path
+func (s *server) allowedMethods(path string) []string {
+	// we strip trailing slashes before routing
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	allowed := make([]string, 0, 1)
+	for _, method := range routeMethods {
+		if s.router.Match(chi.NewRouteContext(), method, path) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
 func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if s.config.StatusUsername != "" {
 		user, pass, ok := r.BasicAuth()
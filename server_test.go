@@ -1,12 +1,16 @@
 package courier
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/courier/utils"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,6 +59,55 @@ func TestServer(t *testing.T) {
 	assert.Contains(t, string(rr.Body), "method not allowed")
 }
 
+func TestHandlerPanic(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	mb := NewMockBackend()
+	s := NewServer(NewConfig(), mb).(*server)
+
+	panicking := func(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+		var payload map[string]string
+		return nil, errors.New(payload["missing"][1:])
+	}
+	wrapped := s.channelHandleWrapper(NewHandler(), panicking)
+
+	// our panic is recovered and turned into a plain 500
+	req := httptest.NewRequest(http.MethodPost, "/c/dm/e4bb1578-29da-4fa5-a214-9da19dd24230/receive", nil)
+	rr := httptest.NewRecorder()
+	assert.NotPanics(t, func() { wrapped(rr, req) })
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), "internal error handling request")
+	assert.NotContains(t, rr.Body.String(), "slice bounds out of range")
+	assert.NotContains(t, rr.Body.String(), "goroutine")
+
+	// and logged with our channel
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "panic handling request" {
+			entry = e
+		}
+	}
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, logrus.ErrorLevel, entry.Level)
+		assert.Equal(t, "e4bb1578-29da-4fa5-a214-9da19dd24230", entry.Data["channel_uuid"].(ChannelUUID).String())
+		assert.Equal(t, ChannelType("DM"), entry.Data["channel_type"])
+		assert.Contains(t, entry.Data["panic"], "slice bounds out of range")
+		assert.NotEmpty(t, entry.Data["stack"])
+	}
+
+	clog, err := mb.GetLastChannelLog()
+	assert.NoError(t, err)
+	assert.Equal(t, "Channel Error", clog.Description)
+	assert.Equal(t, http.StatusInternalServerError, clog.StatusCode)
+	assert.Contains(t, clog.Error, "slice bounds out of range")
+
+	// the wrapper keeps serving requests after a panic
+	rr = httptest.NewRecorder()
+	wrapped(rr, httptest.NewRequest(http.MethodPost, "/c/dm/e4bb1578-29da-4fa5-a214-9da19dd24230/receive", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+}
+
 func TestSanitizeBody(t *testing.T) {
 	tcs := []struct {
 		Label  string
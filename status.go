@@ -1,6 +1,10 @@
 package courier
 
-import "github.com/nyaruka/gocommon/urns"
+import (
+	"time"
+
+	"github.com/nyaruka/gocommon/urns"
+)
 
 // MsgStatusValue is the status of a message
 type MsgStatusValue string
@@ -17,6 +21,26 @@ const (
 	NilMsgStatus MsgStatusValue = ""
 )
 
+// MsgStatusReason is a machine readable reason for why a message errored or failed
+type MsgStatusReason string
+
+// Possible values for MsgStatusReason
+const (
+	MsgReasonTokenError          MsgStatusReason = "token_error"
+	MsgReasonThrottled           MsgStatusReason = "throttled"
+	MsgReasonInvalidDestination  MsgStatusReason = "invalid_destination"
+	MsgReasonInvalidMessage      MsgStatusReason = "invalid_message"
+	MsgReasonProviderError       MsgStatusReason = "provider_error"
+	MsgReasonProviderUnavailable MsgStatusReason = "provider_unavailable"
+	MsgReasonConnectionError     MsgStatusReason = "connection_error"
+	MsgReasonCancelled           MsgStatusReason = "cancelled"
+	MsgReasonUnsupported         MsgStatusReason = "unsupported"
+	MsgReasonConfigError         MsgStatusReason = "config_error"
+	MsgReasonOutsideSendWindow   MsgStatusReason = "outside_send_window"
+	MsgReasonSenderNotAllowed    MsgStatusReason = "sender_not_allowed"
+	NilMsgStatusReason           MsgStatusReason = ""
+)
+
 //-----------------------------------------------------------------------------
 // MsgStatusUpdate Interface
 //-----------------------------------------------------------------------------
@@ -38,6 +62,14 @@ type MsgStatus interface {
 	Status() MsgStatusValue
 	SetStatus(MsgStatusValue)
 
+	// how long the provider asked us to wait before retrying an errored message, zero if it didn't say
+	RetryAfter() time.Duration
+	SetRetryAfter(time.Duration)
+
+	// why the message errored or failed, empty if the handler didn't say
+	Reason() MsgStatusReason
+	SetReason(MsgStatusReason)
+
 	Logs() []*ChannelLog
 	AddLog(log *ChannelLog)
 }
@@ -6,11 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/buger/jsonparser"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/nyaruka/gocommon/uuids"
 
@@ -67,6 +67,12 @@ func NewMockBackend() *MockBackend {
 		log.Fatal(err)
 	}
 
+	return NewMockBackendWithRedisPool(redisPool)
+}
+
+// NewMockBackendWithRedisPool returns a new mock backend which uses the passed in redis pool, e.g. one which doesn't
+// need a Redis server
+func NewMockBackendWithRedisPool(redisPool *redis.Pool) *MockBackend {
 	return &MockBackend{
 		channels:          make(map[ChannelUUID]Channel),
 		channelsByAddress: make(map[ChannelAddress]Channel),
@@ -459,38 +465,12 @@ func (c *MockChannel) StringConfigForKey(key string, defaultValue string) string
 
 // BoolConfigForKey returns the config value for the passed in key
 func (c *MockChannel) BoolConfigForKey(key string, defaultValue bool) bool {
-	val := c.ConfigForKey(key, defaultValue)
-	b, isBool := val.(bool)
-	if !isBool {
-		return defaultValue
-	}
-	return b
+	return BoolConfigForKey(c, key, defaultValue)
 }
 
 // IntConfigForKey returns the config value for the passed in key
 func (c *MockChannel) IntConfigForKey(key string, defaultValue int) int {
-	val := c.ConfigForKey(key, defaultValue)
-
-	// golang unmarshals number literals in JSON into float64s by default
-	f, isFloat := val.(float64)
-	if isFloat {
-		return int(f)
-	}
-
-	// test authors may use literal ints
-	i, isInt := val.(int)
-	if isInt {
-		return i
-	}
-
-	str, isStr := val.(string)
-	if isStr {
-		i, err := strconv.Atoi(str)
-		if err == nil {
-			return i
-		}
-	}
-	return defaultValue
+	return IntConfigForKey(c, key, defaultValue)
 }
 
 // OrgConfigForKey returns the org config value for the passed in key
@@ -589,6 +569,11 @@ func (m *mockMsg) ResponseToID() MsgID          { return m.responseToID }
 func (m *mockMsg) ResponseToExternalID() string { return m.responseToExternalID }
 func (m *mockMsg) Metadata() json.RawMessage    { return m.metadata }
 
+func (m *mockMsg) Campaign() string {
+	campaign, _ := jsonparser.GetString(m.metadata, "campaign")
+	return campaign
+}
+
 func (m *mockMsg) ReceivedOn() *time.Time { return m.receivedOn }
 func (m *mockMsg) SentOn() *time.Time     { return m.sentOn }
 func (m *mockMsg) WiredOn() *time.Time    { return m.wiredOn }
@@ -616,6 +601,8 @@ type mockMsgStatus struct {
 	newURN     urns.URN
 	externalID string
 	status     MsgStatusValue
+	retryAfter time.Duration
+	reason     MsgStatusReason
 	createdOn  time.Time
 
 	logs []*ChannelLog
@@ -646,6 +633,12 @@ func (m *mockMsgStatus) SetExternalID(id string) { m.externalID = id }
 func (m *mockMsgStatus) Status() MsgStatusValue          { return m.status }
 func (m *mockMsgStatus) SetStatus(status MsgStatusValue) { m.status = status }
 
+func (m *mockMsgStatus) RetryAfter() time.Duration              { return m.retryAfter }
+func (m *mockMsgStatus) SetRetryAfter(retryAfter time.Duration) { m.retryAfter = retryAfter }
+
+func (m *mockMsgStatus) Reason() MsgStatusReason          { return m.reason }
+func (m *mockMsgStatus) SetReason(reason MsgStatusReason) { m.reason = reason }
+
 func (m *mockMsgStatus) Logs() []*ChannelLog    { return m.logs }
 func (m *mockMsgStatus) AddLog(log *ChannelLog) { m.logs = append(m.logs, log) }
 
@@ -0,0 +1,14 @@
+// Package test provides helpers for testing code which runs against a courier.Backend, most importantly channel
+// handlers, without a database or Redis server.
+package test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier"
+)
+
+// NewMockBackend returns a new in-memory mock backend whose Redis is a miniredis server of its own
+func NewMockBackend(t testing.TB) *courier.MockBackend {
+	return courier.NewMockBackendWithRedisPool(NewRedisPool(t))
+}
@@ -0,0 +1,28 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewRedisPool returns a redis pool connected to a new miniredis server, so tests can use code which needs Redis
+// without a Redis server. The server is closed when the passed in test finishes.
+func NewRedisPool(t testing.TB) *redis.Pool {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %s", err)
+	}
+	t.Cleanup(server.Close)
+
+	// miniredis can't give us its address once it's closed, and anything still using the pool should just fail to dial
+	addr := server.Addr()
+
+	return &redis.Pool{
+		MaxIdle:     2,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+	}
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisPool(t *testing.T) {
+	rp := NewRedisPool(t)
+	conn := rp.Get()
+	defer conn.Close()
+
+	conn.Do("SET", "foo", "bar")
+	value, err := redis.String(conn.Do("GET", "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+
+	// scripts are supported too
+	value, err = redis.String(conn.Do("EVAL", "return redis.call('GET', KEYS[1])", 1, "foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", value)
+
+	// other connections from the pool share our server, but other pools don't
+	other := rp.Get()
+	defer other.Close()
+	value, _ = redis.String(other.Do("GET", "foo"))
+	assert.Equal(t, "bar", value)
+
+	separate := NewRedisPool(t).Get()
+	defer separate.Close()
+	_, err = redis.String(separate.Do("GET", "foo"))
+	assert.Equal(t, redis.ErrNil, err)
+}
+
+func TestMockBackend(t *testing.T) {
+	mb := NewMockBackend(t)
+	conn := mb.RedisPool().Get()
+	defer conn.Close()
+
+	conn.Do("SET", "foo", "bar")
+	value, _ := redis.String(conn.Do("GET", "foo"))
+	assert.Equal(t, "bar", value)
+
+	// each backend gets its own server
+	conn2 := NewMockBackend(t).RedisPool().Get()
+	defer conn2.Close()
+	_, err := redis.String(conn2.Do("GET", "foo"))
+	assert.Equal(t, redis.ErrNil, err)
+}
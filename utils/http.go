@@ -1,11 +1,17 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,9 +29,13 @@ type RequestResponse struct {
 	StatusCode    int
 	Request       string
 	Response      string
+	Header        http.Header
 	Body          []byte
 	ContentLength int
 	Elapsed       time.Duration
+
+	// BodyTruncated is whether the response body was larger than MaxResponseBodyBytes and so was cut short
+	BodyTruncated bool
 }
 
 const (
@@ -48,16 +58,38 @@ func MakeInsecureHTTPRequest(req *http.Request) (*RequestResponse, error) {
 // MakeHTTPRequest fires the passed in http request, returning any errors encountered. RequestResponse is always set
 // regardless of any errors being set
 func MakeHTTPRequest(req *http.Request) (*RequestResponse, error) {
-	return MakeHTTPRequestWithClient(req, GetHTTPClient())
+	// requests built without a context use context.Background()
+	return MakeHTTPRequestWithContext(req.Context(), req)
+}
+
+// MakeHTTPRequestWithContext fires the passed in http request using the passed in context, so that the request is
+// abandoned if the context is cancelled or its deadline passes. RequestResponse is always set regardless of any errors
+// being set
+func MakeHTTPRequestWithContext(ctx context.Context, req *http.Request) (*RequestResponse, error) {
+	return MakeHTTPRequestWithClient(req.WithContext(ctx), GetHTTPClient())
+}
+
+// MakeMediaHTTPRequest fires the passed in http request to fetch an attachment's media. Media is often bigger than any
+// API response so its body is read in full regardless of MaxResponseBodyBytes.
+func MakeMediaHTTPRequest(req *http.Request) (*RequestResponse, error) {
+	return makeHTTPRequest(req, GetHTTPClient(), 0)
 }
 
 // MakeHTTPRequestWithClient makes an HTTP request with the passed in client, returning a
-// RequestResponse containing logging information gathered during the request
+// RequestResponse containing logging information gathered during the request. Requests are sent with our
+// HTTPUserAgent unless they already have their own User-Agent header.
 func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*RequestResponse, error) {
-	req.Header.Set("User-Agent", HTTPUserAgent)
+	return makeHTTPRequest(req, client, MaxResponseBodyBytes)
+}
+
+// makeHTTPRequest makes an HTTP request with the passed in client, reading no more than maxBodyBytes of the response
+// body, or all of it if that is zero or less
+func makeHTTPRequest(req *http.Request, client *http.Client, maxBodyBytes int) (*RequestResponse, error) {
+	setDefaultUserAgent(req)
 
 	start := time.Now()
 	requestTrace, err := httputil.DumpRequestOut(req, true)
+	requestTrace = redactHeaders(requestTrace, redactedHeaders(req.Context()))
 	if err != nil {
 		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
 		return rr, err
@@ -65,16 +97,220 @@ func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*Request
 
 	resp, err := client.Do(req)
 	if err != nil {
+		// requests which time out are often the slow ones we most want to know the duration of
 		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		rr.Elapsed = time.Now().Sub(start)
 		return rr, err
 	}
 	defer resp.Body.Close()
 
-	rr, err := newRRFromResponse(req.Method, string(requestTrace), resp)
+	rr, err := newRRFromResponse(req.Method, string(requestTrace), resp, maxBodyBytes)
 	rr.Elapsed = time.Now().Sub(start)
 	return rr, err
 }
 
+// RetryOptions control how MakeHTTPRequestWithRetry retries failed requests
+type RetryOptions struct {
+	// MaxAttempts is the most times the request is made including the first, values below 1 mean it is made once
+	MaxAttempts int
+
+	// BaseDelay is how long we wait before the first retry, doubling before each retry after that
+	BaseDelay time.Duration
+
+	// RetryableStatusCodes are the response status codes worth retrying, if nil that is any 5xx status. Connection
+	// failures are always retried.
+	RetryableStatusCodes []int
+
+	// AttemptTimeout if set is how long each attempt is given before it is abandoned
+	AttemptTimeout time.Duration
+
+	// Client if set is the client attempts are made with, otherwise they're made with our shared client
+	Client *http.Client
+}
+
+// isRetryable returns whether the passed in failed attempt is worth retrying
+func (o *RetryOptions) isRetryable(rr *RequestResponse) bool {
+	if rr.Status == RRConnectionFailure {
+		return true
+	}
+	if o.RetryableStatusCodes == nil {
+		return rr.StatusCode/100 == 5
+	}
+	for _, code := range o.RetryableStatusCodes {
+		if rr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeHTTPRequestWithRetry fires the passed in http request, retrying it with exponential backoff as the passed in
+// options describe if it fails with a connection failure or retryable status code. The request body is buffered so
+// that it can be resent with each attempt, and we stop retrying if the request's context is done. The RequestResponse
+// of the final attempt is returned along with those of all of the attempts, in the order they were made.
+func MakeHTTPRequestWithRetry(req *http.Request, opts RetryOptions) (*RequestResponse, []*RequestResponse, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			rr, _ := newRRFromRequestAndError(req, "", err)
+			return rr, []*RequestResponse{rr}, err
+		}
+	}
+
+	ctx := req.Context()
+	delay := opts.BaseDelay
+	attempts := make([]*RequestResponse, 0, 1)
+
+	for {
+		rr, err := makeHTTPRequestAttempt(ctx, req, body, opts.AttemptTimeout, opts.Client)
+		attempts = append(attempts, rr)
+
+		if err == nil || len(attempts) >= opts.MaxAttempts || !opts.isRetryable(rr) {
+			return rr, attempts, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return rr, attempts, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// makeHTTPRequestAttempt makes a single attempt at the passed in request with a fresh copy of the passed in body using
+// the passed in client, or our shared client if that is nil, abandoning it after the passed in timeout if that is set
+func makeHTTPRequestAttempt(ctx context.Context, req *http.Request, body []byte, timeout time.Duration, client *http.Client) (*RequestResponse, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	attempt := req.Clone(ctx)
+	if body != nil {
+		attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		attempt.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+		attempt.ContentLength = int64(len(body))
+	}
+	if client == nil {
+		client = GetHTTPClient()
+	}
+	return MakeHTTPRequestWithClient(attempt, client)
+}
+
+// setDefaultUserAgent sets the User-Agent header of the passed in request to our HTTPUserAgent if it doesn't have one
+func setDefaultUserAgent(req *http.Request) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", HTTPUserAgent)
+	}
+}
+
+// MakeDryRunHTTPRequest traces the passed in http request as MakeHTTPRequest would but doesn't actually send it, instead
+// returning a RequestResponse for a successful response with the passed in content type and body
+func MakeDryRunHTTPRequest(req *http.Request, contentType string, body []byte) (*RequestResponse, error) {
+	setDefaultUserAgent(req)
+
+	requestTrace, err := httputil.DumpRequestOut(req, true)
+	requestTrace = redactHeaders(requestTrace, redactedHeaders(req.Context()))
+	if err != nil {
+		rr, _ := newRRFromRequestAndError(req, string(requestTrace), err)
+		return rr, err
+	}
+
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}, "Content-Length": []string{strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	return newRRFromResponse(req.Method, string(requestTrace), resp, MaxResponseBodyBytes)
+}
+
+// redactedHeadersKey is the context key of the extra headers requests made with a context should have redacted
+type redactedHeadersKey struct{}
+
+// WithRedactedHeaders returns a copy of the passed in context which has the traces of requests made with it also
+// redact the values of the passed in headers, e.g. ones a channel is configured to send credentials in
+func WithRedactedHeaders(ctx context.Context, headers ...string) context.Context {
+	existing := redactedHeaders(ctx)
+	all := make([]string, 0, len(existing)+len(headers))
+	all = append(append(all, existing...), headers...)
+	return context.WithValue(ctx, redactedHeadersKey{}, all)
+}
+
+// redactedHeaders returns the headers whose values are redacted in the traces of requests made with the passed in
+// context, which is our RedactedHeaders plus any it was given by WithRedactedHeaders
+func redactedHeaders(ctx context.Context) []string {
+	headers, _ := ctx.Value(redactedHeadersKey{}).([]string)
+	if headers == nil {
+		return RedactedHeaders
+	}
+	return headers
+}
+
+// redactHeaders replaces the values of the passed in headers in the passed in request trace, keeping the auth scheme
+// if there is one, so that credentials don't end up in our logs
+func redactHeaders(trace []byte, headers []string) []byte {
+	lines := bytes.Split(trace, []byte("\r\n"))
+	for i, line := range lines {
+		// headers end at the first empty line
+		if len(line) == 0 {
+			break
+		}
+
+		for _, header := range headers {
+			prefix := []byte(header + ":")
+			if len(line) < len(prefix) || !bytes.EqualFold(line[:len(prefix)], prefix) {
+				continue
+			}
+
+			value := bytes.TrimSpace(line[len(prefix):])
+			redacted := []byte(redactedValue)
+			if space := bytes.IndexByte(value, ' '); space > 0 {
+				redacted = append(append([]byte{}, value[:space+1]...), redacted...)
+			}
+			lines[i] = append(append(line[:len(prefix):len(prefix)], ' '), redacted...)
+		}
+	}
+	return bytes.Join(lines, []byte("\r\n"))
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date, into
+// how long after the passed in time we should wait before retrying. False is returned if the value can't be parsed.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	// dates in the past mean we can retry straight away
+	if !date.After(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
 // newRRFromResponse creates a new RequestResponse based on the passed in http request and error (when we received no response)
 func newRRFromRequestAndError(r *http.Request, requestTrace string, requestError error) (*RequestResponse, error) {
 	rr := RequestResponse{ContentLength: -1}
@@ -88,13 +324,15 @@ func newRRFromRequestAndError(r *http.Request, requestTrace string, requestError
 	return &rr, nil
 }
 
-// newRRFromResponse creates a new RequestResponse based on the passed in http Response
-func newRRFromResponse(method string, requestTrace string, r *http.Response) (*RequestResponse, error) {
+// newRRFromResponse creates a new RequestResponse based on the passed in http Response, reading no more than
+// maxBodyBytes of its body unless that is zero or less
+func newRRFromResponse(method string, requestTrace string, r *http.Response, maxBodyBytes int) (*RequestResponse, error) {
 	var err error
 	rr := RequestResponse{ContentLength: -1}
 	rr.Method = method
 	rr.URL = r.Request.URL.String()
 	rr.StatusCode = r.StatusCode
+	rr.Header = r.Header
 
 	// set our content length if we have its header
 
@@ -114,6 +352,30 @@ func newRRFromResponse(method string, requestTrace string, r *http.Response) (*R
 
 	rr.Request = requestTrace
 
+	// read no more of the body than our limit, one byte over it lets us know whether it was truncated
+	var bodyBytes []byte
+	if maxBodyBytes > 0 {
+		bodyBytes, err = ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBodyBytes)+1))
+		if err != nil {
+			return &rr, err
+		}
+		if len(bodyBytes) > maxBodyBytes {
+			bodyBytes = bodyBytes[:maxBodyBytes]
+			rr.BodyTruncated = true
+		}
+	} else {
+		bodyBytes, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return &rr, err
+		}
+	}
+
+	// dump what we read rather than the original body, which has already been consumed
+	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	if rr.BodyTruncated {
+		r.ContentLength = int64(len(bodyBytes))
+	}
+
 	// figure out if our Response is something that looks like text from our headers
 	isText := false
 	contentType := r.Header.Get("Content-Type")
@@ -135,10 +397,8 @@ func newRRFromResponse(method string, requestTrace string, r *http.Response) (*R
 	}
 
 	rr.Response = string(response)
-
-	bodyBytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return &rr, err
+	if rr.BodyTruncated {
+		rr.Response += fmt.Sprintf(truncatedMarker, maxBodyBytes)
 	}
 	rr.Body = bodyBytes
 
@@ -147,6 +407,11 @@ func newRRFromResponse(method string, requestTrace string, r *http.Response) (*R
 		err = fmt.Errorf("received non 200 status: %d", rr.StatusCode)
 	}
 
+	// or if we didn't read all of the body, as whatever callers do with what we did read will be wrong
+	if err == nil && rr.BodyTruncated {
+		err = fmt.Errorf("response body larger than %d bytes", maxBodyBytes)
+	}
+
 	return &rr, err
 }
 
@@ -158,7 +423,7 @@ func GetHTTPClient() *http.Client {
 		transport.MaxIdleConnsPerHost = 8
 		transport.IdleConnTimeout = 15 * time.Second
 		client = &http.Client{
-			Transport: transport,
+			Transport: &overridableTransport{transport},
 			Timeout:   60 * time.Second,
 		}
 	})
@@ -175,7 +440,7 @@ func GetInsecureHTTPClient() *http.Client {
 		insecureTransport.IdleConnTimeout = 15 * time.Second
 		insecureTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 		insecureClient = &http.Client{
-			Transport: insecureTransport,
+			Transport: &overridableTransport{insecureTransport},
 			Timeout:   60 * time.Second,
 		}
 	})
@@ -183,7 +448,200 @@ func GetInsecureHTTPClient() *http.Client {
 	return insecureClient
 }
 
+// TLSOptions control the TLS settings of the connections made by a client from GetTLSHTTPClient, and the proxy they
+// are made through
+type TLSOptions struct {
+	// MinVersion is the oldest TLS version we'll connect with, e.g. tls.VersionTLS12, zero means TLS 1.2
+	MinVersion uint16
+
+	// ClientCert and ClientKey are the PEM encoded certificate and key we present for mutual TLS, if set
+	ClientCert string
+	ClientKey  string
+
+	// InsecureSkipVerify disables validating the certificates of servers, which should only ever be used for staging
+	InsecureSkipVerify bool
+
+	// Proxy is the URL of the proxy we make requests through, as parsed by ParseProxyURL, if set
+	Proxy *url.URL
+}
+
+// IsDefault returns whether these options are the same as the settings of our shared client
+func (o TLSOptions) IsDefault() bool {
+	return o == TLSOptions{}
+}
+
+// CacheKey returns the key the client for these options is cached under, which is a hash of them so that we don't hold
+// on to client keys any longer than their clients
+func (o TLSOptions) CacheKey() string {
+	proxy := ""
+	if o.Proxy != nil {
+		proxy = o.Proxy.String()
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\x00%t\x00%s\x00%s\x00%s", o.MinVersion, o.InsecureSkipVerify, proxy, o.ClientCert, o.ClientKey)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// tlsConfig builds the TLS config for these options, returning an error if the client certificate can't be loaded
+func (o TLSOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: o.MinVersion, InsecureSkipVerify: o.InsecureSkipVerify}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if o.ClientCert != "" || o.ClientKey != "" {
+		cert, err := LoadClientCertificate(o.ClientCert, o.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// LoadClientCertificate loads the passed in PEM encoded certificate and key, returning an error if they aren't a
+// valid pair
+func LoadClientCertificate(certPEM string, keyPEM string) (tls.Certificate, error) {
+	if certPEM == "" || keyPEM == "" {
+		return tls.Certificate{}, fmt.Errorf("client certificate and key must both be set")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate: %s", err)
+	}
+	return cert, nil
+}
+
+// ParseTLSVersion parses a TLS version like "1.2" into its tls package constant
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version: %s", version)
+}
+
+// ParseProxyURL parses the passed in proxy URL, returning an error unless it is an absolute http, https or socks5 URL
+func ParseProxyURL(proxy string) (*url.URL, error) {
+	proxyURL, err := url.Parse(strings.TrimSpace(proxy))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL has no host: %s", proxy)
+	}
+	return proxyURL, nil
+}
+
+// GetTLSHTTPClient returns the HTTP client for the passed in TLS options, which is our shared client if they are the
+// defaults. Clients are created once for each set of options and then reused so that their connections are pooled,
+// with no more than MaxTLSClients kept at once, the oldest being dropped to make room for new ones.
+func GetTLSHTTPClient(opts TLSOptions) (*http.Client, error) {
+	if opts.IsDefault() {
+		return GetHTTPClient(), nil
+	}
+
+	key := opts.CacheKey()
+
+	tlsClientsMutex.Lock()
+	defer tlsClientsMutex.Unlock()
+
+	if cached, found := tlsClients[key]; found {
+		return cached.client, nil
+	}
+
+	config, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsTransport.MaxIdleConns = 64
+	tlsTransport.MaxIdleConnsPerHost = 8
+	tlsTransport.IdleConnTimeout = 15 * time.Second
+	tlsTransport.TLSClientConfig = config
+
+	if opts.Proxy != nil {
+		tlsTransport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+
+	client := &http.Client{
+		Transport: &overridableTransport{tlsTransport},
+		Timeout:   60 * time.Second,
+	}
+
+	for len(tlsClientKeys) > 0 && len(tlsClientKeys) >= MaxTLSClients {
+		evictTLSHTTPClient(tlsClientKeys[0])
+	}
+
+	tlsClients[key] = &tlsClient{client: client, transport: tlsTransport}
+	tlsClientKeys = append(tlsClientKeys, key)
+	return client, nil
+}
+
+// EvictTLSHTTPClient drops the client cached under the passed in key from TLSOptions.CacheKey if there is one, closing
+// its idle connections, e.g. once the config it was created for has changed. Requests already using it are unaffected.
+func EvictTLSHTTPClient(key string) {
+	tlsClientsMutex.Lock()
+	defer tlsClientsMutex.Unlock()
+
+	evictTLSHTTPClient(key)
+}
+
+// evictTLSHTTPClient drops the client cached under the passed in key, tlsClientsMutex must be held
+func evictTLSHTTPClient(key string) {
+	cached, found := tlsClients[key]
+	if !found {
+		return
+	}
+	cached.transport.CloseIdleConnections()
+	delete(tlsClients, key)
+
+	for i, k := range tlsClientKeys {
+		if k == key {
+			tlsClientKeys = append(tlsClientKeys[:i], tlsClientKeys[i+1:]...)
+			break
+		}
+	}
+}
+
+// tlsClient is a client created by GetTLSHTTPClient and the transport its connections are pooled in
+type tlsClient struct {
+	client    *http.Client
+	transport *http.Transport
+}
+
+// overridableTransport sends requests through HTTPTransport if it is set, otherwise through its default transport
+type overridableTransport struct {
+	defaultTransport http.RoundTripper
+}
+
+func (t *overridableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if HTTPTransport != nil {
+		return HTTPTransport.RoundTrip(req)
+	}
+	return t.defaultTransport.RoundTrip(req)
+}
+
 var (
+	// HTTPTransport if set is used by our shared clients instead of the network, e.g. so tests can record requests
+	HTTPTransport http.RoundTripper
+
 	transport *http.Transport
 	client    *http.Client
 	once      sync.Once
@@ -192,5 +650,23 @@ var (
 	insecureClient    *http.Client
 	insecureOnce      sync.Once
 
+	// MaxTLSClients is the most clients GetTLSHTTPClient keeps at once
+	MaxTLSClients = 100
+
+	tlsClients      = make(map[string]*tlsClient)
+	tlsClientKeys   []string // in the order they were created, oldest first
+	tlsClientsMutex sync.Mutex
+
 	HTTPUserAgent = "Courier/vDev"
+
+	// RedactedHeaders are the request headers whose values are replaced in request traces
+	RedactedHeaders = []string{"Authorization", "X-API-Token"}
+
+	redactedValue = "****"
+
+	// MaxResponseBodyBytes is the most of each response body we read, anything past it is dropped, the
+	// RequestResponse marked as truncated and an error returned. Zero or less means bodies are read in full.
+	MaxResponseBodyBytes = 4 * 1024 * 1024
+
+	truncatedMarker = "\n... response body truncated at %d bytes"
 )
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// RecordedRequest is a request made through a RecordingTransport
+type RecordedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   string
+}
+
+// RecordingTransport is an http.RoundTripper which records the requests made through it and responds to them using
+// its handler instead of the network. Set it as HTTPTransport to use it for all requests made with our shared clients.
+type RecordingTransport struct {
+	handler  http.Handler
+	mutex    sync.Mutex
+	requests []*RecordedRequest
+}
+
+// NewRecordingTransport creates a new recording transport which responds to requests using the passed in handler
+func NewRecordingTransport(handler http.Handler) *RecordingTransport {
+	return &RecordingTransport{handler: handler}
+}
+
+// RoundTrip records the passed in request and returns the response of our handler to it
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	t.mutex.Lock()
+	t.requests = append(t.requests, &RecordedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   string(body),
+	})
+	t.mutex.Unlock()
+
+	// hand our handler a copy of the request with its body restored
+	serverReq := req.Clone(req.Context())
+	serverReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	serverReq.RequestURI = req.URL.RequestURI()
+
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, serverReq)
+
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// Requests returns the requests made through this transport so far, in the order they were made
+func (t *RecordingTransport) Requests() []*RecordedRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	requests := make([]*RecordedRequest, len(t.requests))
+	copy(requests, t.requests)
+	return requests
+}